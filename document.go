@@ -0,0 +1,254 @@
+package gqlhive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/formatter"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+// operationDocument parses the query and keeps only the operation with the given name
+// together with the fragments it uses, directly or through other fragments.
+// The returned document is not validated against the schema and can be freely modified.
+func operationDocument(query, operationName string) (*ast.QueryDocument, error) {
+	doc, err := parser.ParseQuery(&ast.Source{Input: query})
+	if err != nil {
+		return nil, err
+	}
+	operation := doc.Operations.ForName(operationName)
+	if operation == nil {
+		return nil, fmt.Errorf("operation %q not found", operationName)
+	}
+
+	var fragments ast.FragmentDefinitionList
+	var visit func(selSet ast.SelectionSet)
+	visit = func(selSet ast.SelectionSet) {
+		for _, sel := range selSet {
+			switch sel := sel.(type) {
+			case *ast.Field:
+				visit(sel.SelectionSet)
+			case *ast.FragmentSpread:
+				if fragments.ForName(sel.Name) != nil {
+					// already used
+					continue
+				}
+				if fragment := doc.Fragments.ForName(sel.Name); fragment != nil {
+					fragments = append(fragments, fragment)
+					visit(fragment.SelectionSet)
+				}
+			case *ast.InlineFragment:
+				visit(sel.SelectionSet)
+			}
+		}
+	}
+	visit(operation.SelectionSet)
+
+	return &ast.QueryDocument{
+		Operations: ast.OperationList{operation},
+		Fragments:  fragments,
+	}, nil
+}
+
+// normalizeDocument normalizes the document in place by hiding literal values, removing aliases and sorting
+// everything that can be sorted. Operations differing only in formatting, literal values, aliases or the order
+// of fields and arguments end up with the same document.
+func normalizeDocument(doc *ast.QueryDocument) {
+	for _, operation := range doc.Operations {
+		slices.SortFunc(operation.VariableDefinitions, func(a, b *ast.VariableDefinition) int {
+			return strings.Compare(a.Variable, b.Variable)
+		})
+		for _, variable := range operation.VariableDefinitions {
+			normalizeValue(variable.DefaultValue)
+			normalizeDirectives(variable.Directives)
+		}
+		normalizeDirectives(operation.Directives)
+		normalizeSelectionSet(operation.SelectionSet)
+	}
+	slices.SortFunc(doc.Fragments, func(a, b *ast.FragmentDefinition) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	for _, fragment := range doc.Fragments {
+		normalizeDirectives(fragment.Directives)
+		normalizeSelectionSet(fragment.SelectionSet)
+	}
+}
+
+func normalizeSelectionSet(selSet ast.SelectionSet) {
+	for _, sel := range selSet {
+		switch sel := sel.(type) {
+		case *ast.Field:
+			sel.Alias = ""
+			normalizeArguments(sel.Arguments)
+			normalizeDirectives(sel.Directives)
+			normalizeSelectionSet(sel.SelectionSet)
+		case *ast.FragmentSpread:
+			normalizeDirectives(sel.Directives)
+		case *ast.InlineFragment:
+			normalizeDirectives(sel.Directives)
+			normalizeSelectionSet(sel.SelectionSet)
+		}
+	}
+	// the printed selections are sorted because selections of different kinds,
+	// or the same fields with different arguments, have no other natural order
+	keys := make(map[ast.Selection]string, len(selSet))
+	for _, sel := range selSet {
+		keys[sel] = printDocument(&ast.QueryDocument{
+			Operations: ast.OperationList{{
+				Operation:    ast.Query,
+				SelectionSet: ast.SelectionSet{sel},
+			}},
+		})
+	}
+	slices.SortStableFunc(selSet, func(a, b ast.Selection) int {
+		return strings.Compare(keys[a], keys[b])
+	})
+}
+
+func normalizeDirectives(directives ast.DirectiveList) {
+	slices.SortStableFunc(directives, func(a, b *ast.Directive) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	for _, directive := range directives {
+		normalizeArguments(directive.Arguments)
+	}
+}
+
+func normalizeArguments(args ast.ArgumentList) {
+	slices.SortFunc(args, func(a, b *ast.Argument) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	for _, arg := range args {
+		normalizeValue(arg.Value)
+	}
+}
+
+// normalizeValue hides literal numbers and strings, and sorts object fields.
+// Enums, booleans, nulls and variables are kept.
+func normalizeValue(value *ast.Value) {
+	if value == nil {
+		return
+	}
+	hideLiteral(value)
+	if value.Kind == ast.ObjectValue {
+		slices.SortStableFunc(value.Children, func(a, b *ast.ChildValue) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+	}
+	for _, child := range value.Children {
+		normalizeValue(child.Value)
+	}
+}
+
+// hideLiteral replaces literal numbers with zeros and literal strings with empty strings.
+func hideLiteral(value *ast.Value) {
+	switch value.Kind {
+	case ast.IntValue, ast.FloatValue:
+		value.Raw = "0"
+	case ast.StringValue, ast.BlockValue:
+		value.Kind = ast.StringValue
+		value.Raw = ""
+	}
+}
+
+// apply applies the privacy policy to the document in place.
+func (policy PrivacyPolicy) apply(doc *ast.QueryDocument) {
+	if !policy.HideLiterals && len(policy.RedactArguments) == 0 {
+		return
+	}
+	var visitValue func(value *ast.Value)
+	visitValue = func(value *ast.Value) {
+		if value == nil {
+			return
+		}
+		if policy.HideLiterals {
+			hideLiteral(value)
+		}
+		for _, child := range value.Children {
+			if value.Kind == ast.ObjectValue && slices.Contains(policy.RedactArguments, child.Name) {
+				redactValue(child.Value)
+				continue
+			}
+			visitValue(child.Value)
+		}
+	}
+	visitArguments := func(args ast.ArgumentList) {
+		for _, arg := range args {
+			if slices.Contains(policy.RedactArguments, arg.Name) {
+				redactValue(arg.Value)
+				continue
+			}
+			visitValue(arg.Value)
+		}
+	}
+	visitDirectives := func(directives ast.DirectiveList) {
+		for _, directive := range directives {
+			visitArguments(directive.Arguments)
+		}
+	}
+	var visitSelectionSet func(selSet ast.SelectionSet)
+	visitSelectionSet = func(selSet ast.SelectionSet) {
+		for _, sel := range selSet {
+			switch sel := sel.(type) {
+			case *ast.Field:
+				visitArguments(sel.Arguments)
+				visitDirectives(sel.Directives)
+				visitSelectionSet(sel.SelectionSet)
+			case *ast.FragmentSpread:
+				visitDirectives(sel.Directives)
+			case *ast.InlineFragment:
+				visitDirectives(sel.Directives)
+				visitSelectionSet(sel.SelectionSet)
+			}
+		}
+	}
+
+	for _, operation := range doc.Operations {
+		for _, variable := range operation.VariableDefinitions {
+			if slices.Contains(policy.RedactArguments, variable.Variable) {
+				redactValue(variable.DefaultValue)
+			} else {
+				visitValue(variable.DefaultValue)
+			}
+			visitDirectives(variable.Directives)
+		}
+		visitDirectives(operation.Directives)
+		visitSelectionSet(operation.SelectionSet)
+	}
+	for _, fragment := range doc.Fragments {
+		visitDirectives(fragment.Directives)
+		visitSelectionSet(fragment.SelectionSet)
+	}
+}
+
+// redactedValue replaces the values of redacted arguments.
+const redactedValue = "[REDACTED]"
+
+// redactValue replaces the value in place, variables are kept because they reveal nothing.
+func redactValue(value *ast.Value) {
+	if value == nil || value.Kind == ast.Variable {
+		return
+	}
+	*value = ast.Value{
+		Kind:     ast.StringValue,
+		Raw:      redactedValue,
+		Position: value.Position,
+	}
+}
+
+// hashedDocument replaces the document with its SHA-256 hash.
+func hashedDocument(document string) string {
+	hash := sha256.Sum256([]byte(document))
+	return "# sha256:" + hex.EncodeToString(hash[:]) + "\n{ __typename }"
+}
+
+// printDocument prints the document, without comments unless the formatter is told otherwise.
+func printDocument(doc *ast.QueryDocument, opts ...formatter.FormatterOption) string {
+	var str strings.Builder
+	formatter.NewFormatter(&str, opts...).FormatQueryDocument(doc)
+	return str.String()
+}
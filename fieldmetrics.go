@@ -0,0 +1,148 @@
+package gqlhive
+
+import (
+	"context"
+	"math/bits"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+)
+
+// FieldMetric are the metrics of a field, identified by its schema coordinate, resolved during a flush window.
+type FieldMetric struct {
+	// Number of times the field was resolved
+	Calls uint64 `json:"calls"`
+	// Number of times resolving the field failed
+	Errors uint64 `json:"errors"`
+	// Estimated latency percentiles of resolving the field in nanoseconds
+	P50 int64 `json:"p50"`
+	P95 int64 `json:"p95"`
+	P99 int64 `json:"p99"`
+}
+
+// latencyBuckets is the number of buckets in the latency histograms. Bucket i counts the latencies
+// below 1µs << i, the last bucket counts all the latencies that didn't fit the others.
+const latencyBuckets = 32
+
+// fieldMetrics aggregates the metrics of the resolved fields in a single flush window.
+type fieldMetrics struct {
+	fields sync.Map // map[string]*fieldMetricsRecorder
+}
+
+type fieldMetricsRecorder struct {
+	calls   atomic.Uint64
+	errors  atomic.Uint64
+	latency [latencyBuckets]atomic.Uint64
+}
+
+func (metrics *fieldMetrics) record(coordinate string, latency time.Duration, failed bool) {
+	recorder, ok := metrics.fields.Load(coordinate)
+	if !ok {
+		recorder, _ = metrics.fields.LoadOrStore(coordinate, &fieldMetricsRecorder{})
+	}
+	recorder.(*fieldMetricsRecorder).record(latency, failed)
+}
+
+func (recorder *fieldMetricsRecorder) record(latency time.Duration, failed bool) {
+	recorder.calls.Add(1)
+	if failed {
+		recorder.errors.Add(1)
+	}
+	bucket := 0
+	if latency > 0 {
+		bucket = min(bits.Len64(uint64(latency/time.Microsecond)), latencyBuckets-1)
+	}
+	recorder.latency[bucket].Add(1)
+}
+
+// snapshot returns the metrics of all fields recorded so far, or nil when there are none.
+func (metrics *fieldMetrics) snapshot() map[string]FieldMetric {
+	var snapshot map[string]FieldMetric
+	metrics.fields.Range(func(coordinate, recorder any) bool {
+		if snapshot == nil {
+			snapshot = map[string]FieldMetric{}
+		}
+		snapshot[coordinate.(string)] = recorder.(*fieldMetricsRecorder).metric()
+		return true
+	})
+	return snapshot
+}
+
+func (recorder *fieldMetricsRecorder) metric() FieldMetric {
+	var latency [latencyBuckets]uint64
+	var total uint64
+	for i := range recorder.latency {
+		latency[i] = recorder.latency[i].Load()
+		total += latency[i]
+	}
+	// the percentiles are the upper bounds of the buckets they fall into
+	percentile := func(p float64) int64 {
+		target := uint64(p * float64(total))
+		var count uint64
+		for i, n := range latency {
+			count += n
+			if n != 0 && count >= target {
+				return int64(time.Microsecond << i)
+			}
+		}
+		return 0
+	}
+	return FieldMetric{
+		Calls:  recorder.calls.Load(),
+		Errors: recorder.errors.Load(),
+		P50:    percentile(0.50),
+		P95:    percentile(0.95),
+		P99:    percentile(0.99),
+	}
+}
+
+// FieldMetrics returns the metrics of the fields resolved since the last report was sent, keyed by their
+// schema coordinates e.g. "Query.todos". Returns nil when there are no metrics or they are disabled.
+func (tracer *Tracer) FieldMetrics() map[string]FieldMetric {
+	if !tracer.fieldMetricsEnabled {
+		return nil
+	}
+	tracer.fieldMetricsMtx.RLock()
+	defer tracer.fieldMetricsMtx.RUnlock()
+	return tracer.fieldMetrics.snapshot()
+}
+
+// takeFieldMetrics starts a new flush window and returns the metrics of the previous one.
+func (tracer *Tracer) takeFieldMetrics() map[string]FieldMetric {
+	if !tracer.fieldMetricsEnabled {
+		return nil
+	}
+	tracer.fieldMetricsMtx.Lock()
+	metrics := tracer.fieldMetrics
+	tracer.fieldMetrics = &fieldMetrics{}
+	tracer.fieldMetricsMtx.Unlock()
+	return metrics.snapshot()
+}
+
+// InterceptField intercepts resolving the field and records its metrics when enabled.
+func (tracer *Tracer) InterceptField(ctx context.Context, next graphql.Resolver) (any, error) {
+	if !tracer.fieldMetricsEnabled {
+		return next(ctx)
+	}
+
+	fieldCtx := graphql.GetFieldContext(ctx)
+	if fieldCtx == nil || strings.HasPrefix(fieldCtx.Object, "__") || strings.HasPrefix(fieldCtx.Field.Name, "__") {
+		// introspection fields are not part of the schema
+		return next(ctx)
+	}
+
+	start := time.Now()
+	res, err := next(ctx)
+	latency := time.Since(start)
+
+	failed := err != nil || len(graphql.GetFieldErrors(ctx, fieldCtx)) != 0
+	// the lock is held only while recording, resolving the field must not hold up sending the report
+	tracer.fieldMetricsMtx.RLock()
+	tracer.fieldMetrics.record(fieldCtx.Object+"."+fieldCtx.Field.Name, latency, failed)
+	tracer.fieldMetricsMtx.RUnlock()
+
+	return res, err
+}
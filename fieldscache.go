@@ -0,0 +1,123 @@
+package gqlhive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/99designs/gqlgen/graphql"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// fieldsCache caches the reported documents and schema coordinates of operations so
+// that frequently executed operations don't have their documents walked on every execution.
+type fieldsCache struct {
+	cache  *lru.Cache[string, *reportedOperation]
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// reportedOperation is the document, ID and schema coordinates of the operation as they are reported.
+// The ID is empty when it's generated by a custom generator.
+type reportedOperation struct {
+	document string
+	id       string
+	fields   []string
+}
+
+func newFieldsCache(size int) *fieldsCache {
+	cache, err := lru.New[string, *reportedOperation](size)
+	if err != nil {
+		// only when the size is not positive
+		panic(err)
+	}
+	return &fieldsCache{cache: cache}
+}
+
+// CacheStats are the statistics of a cache.
+type CacheStats struct {
+	// Number of lookups that found the entry in the cache
+	Hits uint64
+	// Number of lookups that didn't find the entry in the cache
+	Misses uint64
+	// Number of entries currently in the cache
+	Size int
+}
+
+// FieldsCacheStats returns the statistics of the operation fields cache.
+// All stats are zero when the cache is disabled.
+func (tracer *Tracer) FieldsCacheStats() CacheStats {
+	if tracer.fieldsCache == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:   tracer.fieldsCache.hits.Load(),
+		Misses: tracer.fieldsCache.misses.Load(),
+		Size:   tracer.fieldsCache.cache.Len(),
+	}
+}
+
+// reportedOperation creates the reported document, ID and fields of the operation, the ones of the document are taken
+// from the cache under the given key, see [fieldsCacheKey], when possible. The returned fields may be shared and must
+// not be modified.
+func (tracer *Tracer) reportedOperation(operationCtx *graphql.OperationContext, key string) (document, id string, fields []string) {
+	operation := tracer.cachedOperation(operationCtx, key)
+	document, id, fields = operation.document, operation.id, operation.fields
+	if id == "" {
+		// custom generators could create a different ID for every execution
+		id = tracer.operationID(operationCtx, document)
+	}
+	if len(operationCtx.Operation.VariableDefinitions) != 0 {
+		fields = mergeFields(fields, createFieldsForVariables(tracer.schema, operationCtx.Operation, operationCtx.Variables))
+	}
+	return document, id, fields
+}
+
+// cachedOperation creates the reported document, the ID when using the default generator and the fields of the
+// operation document or takes them from the cache. The returned operation is shared and must not be modified.
+func (tracer *Tracer) cachedOperation(operationCtx *graphql.OperationContext, key string) *reportedOperation {
+	if tracer.fieldsCache == nil {
+		return tracer.newReportedOperation(operationCtx)
+	}
+
+	if operation, ok := tracer.fieldsCache.cache.Get(key); ok {
+		tracer.fieldsCache.hits.Add(1)
+		return operation
+	}
+	tracer.fieldsCache.misses.Add(1)
+
+	operation := tracer.newReportedOperation(operationCtx)
+	tracer.fieldsCache.cache.Add(key, operation)
+	return operation
+}
+
+// newReportedOperation creates the reported document, ID and fields of the operation document.
+func (tracer *Tracer) newReportedOperation(operationCtx *graphql.OperationContext) *reportedOperation {
+	operation := &reportedOperation{
+		document: tracer.documentForOperation(operationCtx.RawQuery, operationCtx.OperationName),
+		fields:   createFieldsForOperation(tracer.schema, operationCtx.Operation, operationCtx.Variables, tracer.conditionalFields),
+	}
+	if tracer.generateID == nil {
+		operation.id = tracer.operationID(operationCtx, operation.document)
+	}
+	return operation
+}
+
+// fieldsCacheKey is the hash of the document together with the name of the executed operation. When the @skip
+// and @include directives are evaluated, the values of the boolean variables they could use are part of the key too.
+func fieldsCacheKey(operationCtx *graphql.OperationContext, policy ConditionalFields) string {
+	hash := sha256.New()
+	hash.Write([]byte(operationCtx.RawQuery))
+	hash.Write([]byte{0})
+	hash.Write([]byte(operationCtx.OperationName))
+	if policy == ConditionalFieldsEvaluated {
+		for _, variable := range operationCtx.Operation.VariableDefinitions {
+			if variable.Type == nil || variable.Type.NamedType != "Boolean" {
+				continue
+			}
+			fmt.Fprintf(hash, "\x00%s=%v", variable.Variable, operationCtx.Variables[variable.Variable])
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
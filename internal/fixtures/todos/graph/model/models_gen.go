@@ -9,6 +9,15 @@ import (
 	"strconv"
 )
 
+type Node interface {
+	IsNode()
+	GetID() string
+}
+
+type SearchResult interface {
+	IsSearchResult()
+}
+
 type Mutation struct {
 }
 
@@ -20,13 +29,23 @@ type NewTodo struct {
 type Query struct {
 }
 
+type Subscription struct {
+}
+
 type Todo struct {
 	ID   string `json:"id"`
 	Text string `json:"text"`
 	Done bool   `json:"done"`
 	User *User  `json:"user"`
+	// Always fails resolving.
+	Failing *string `json:"failing,omitempty"`
 }
 
+func (Todo) IsNode()            {}
+func (this Todo) GetID() string { return this.ID }
+
+func (Todo) IsSearchResult() {}
+
 type TodosCondition struct {
 	SearchText *string                   `json:"searchText,omitempty"`
 	Statuses   []TodosConditionStatus    `json:"statuses,omitempty"`
@@ -44,6 +63,11 @@ type User struct {
 	Todos []*Todo `json:"todos"`
 }
 
+func (User) IsNode()            {}
+func (this User) GetID() string { return this.ID }
+
+func (User) IsSearchResult() {}
+
 type TodosConditionStatus string
 
 const (
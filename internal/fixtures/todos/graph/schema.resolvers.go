@@ -7,6 +7,7 @@ package graph
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/enisdenjo/go-gqlhive/internal/fixtures/todos/graph/model"
 )
@@ -38,11 +39,71 @@ func (r *queryResolver) Todos(ctx context.Context, condition *model.TodosConditi
 	return todos, nil
 }
 
+// Node is the resolver for the node field.
+func (r *queryResolver) Node(ctx context.Context, id string) (model.Node, error) {
+	for _, todo := range todos {
+		if todo.ID == id {
+			return todo, nil
+		}
+	}
+	for _, user := range users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+// Search is the resolver for the search field.
+func (r *queryResolver) Search(ctx context.Context, text string) ([]model.SearchResult, error) {
+	var results []model.SearchResult
+	for _, todo := range todos {
+		if strings.Contains(todo.Text, text) {
+			results = append(results, todo)
+		}
+	}
+	for _, user := range users {
+		if strings.Contains(user.Name, text) {
+			results = append(results, user)
+		}
+	}
+	return results, nil
+}
+
+// Todos is the resolver for the todos field.
+func (r *subscriptionResolver) Todos(ctx context.Context) (<-chan *model.Todo, error) {
+	ch := make(chan *model.Todo)
+	go func() {
+		defer close(ch)
+		for _, todo := range todos {
+			select {
+			case ch <- todo:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Failing is the resolver for the failing field.
+func (r *todoResolver) Failing(ctx context.Context, obj *model.Todo) (*string, error) {
+	return nil, fmt.Errorf("todo %q failed", obj.ID)
+}
+
 // Mutation returns MutationResolver implementation.
 func (r *Resolver) Mutation() MutationResolver { return &mutationResolver{r} }
 
 // Query returns QueryResolver implementation.
 func (r *Resolver) Query() QueryResolver { return &queryResolver{r} }
 
+// Subscription returns SubscriptionResolver implementation.
+func (r *Resolver) Subscription() SubscriptionResolver { return &subscriptionResolver{r} }
+
+// Todo returns TodoResolver implementation.
+func (r *Resolver) Todo() TodoResolver { return &todoResolver{r} }
+
 type mutationResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
+type subscriptionResolver struct{ *Resolver }
+type todoResolver struct{ *Resolver }
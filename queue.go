@@ -0,0 +1,499 @@
+package gqlhive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+func (tracer *Tracer) queueOperation(operation *OperationWithInfo) error {
+	return tracer.queue(operation.ID, &operation.Operation, func(report *Report) {
+		report.OperationInfos = append(report.OperationInfos, &operation.OperationInfo)
+	})
+}
+
+func (tracer *Tracer) queueSubscriptionOperation(operation *Operation, info *SubscriptionOperationInfo) error {
+	return tracer.queue(info.ID, operation, func(report *Report) {
+		report.SubscriptionOperationInfos = append(report.SubscriptionOperationInfos, info)
+	})
+}
+
+// queue adds the operation with the given ID to the queued report and appends its info using the provided function.
+func (tracer *Tracer) queue(id string, operation *Operation, appendInfo func(report *Report)) error {
+	tracer.queuedReportMtx.Lock()
+	defer tracer.queuedReportMtx.Unlock()
+
+	if tracer.closed.Load() {
+		return errors.New("tracer is closed")
+	}
+
+	if tracer.queuedReport == nil {
+		tracer.queuedReport = &Report{
+			Operations: map[string]*Operation{},
+		}
+		tracer.queuedRefs = map[string]uint{}
+		tracer.queuedFields = map[string]map[string]struct{}{}
+		tracer.queuedBytes = 0
+	}
+
+	if tracer.maxQueuedBytes != 0 && uint(operationInfoBytes+operationBytes(operation)) > tracer.maxQueuedBytes {
+		// would never fit, dropping the queued operations won't make room for it
+		tracer.droppedOperations.Add(1)
+		return nil
+	}
+
+	tracer.queuedSeen++
+	added, bytes := tracer.operationQueueBytes(id, operation)
+	if tracer.queueFull(1, bytes) {
+		if tracer.dropPolicy == DropSample && rand.Float64()*float64(tracer.queuedSeen) >= float64(tracer.queuedReport.Size) {
+			// reservoir sampling, the operation makes it into the sample with the probability of queued/seen
+			tracer.droppedOperations.Add(1)
+			return nil
+		}
+		if tracer.dropPolicy != DropNewest {
+			tracer.dropQueuedOperations(1, bytes)
+			// dropping could have removed the queued operation, it then has to be queued whole
+			added, bytes = tracer.operationQueueBytes(id, operation)
+			tracer.dropQueuedOperations(1, bytes)
+		}
+		if tracer.queueFull(1, bytes) {
+			tracer.droppedOperations.Add(1)
+			return nil
+		}
+	}
+
+	tracer.queuedReport.Size++
+	// the same operation executed multiple times is stored once and referenced by each info
+	if _, exists := tracer.queuedReport.Operations[id]; exists {
+		tracer.addQueuedFields(id, added)
+	} else {
+		tracer.queuedReport.Operations[id] = operation
+	}
+	appendInfo(tracer.queuedReport)
+	tracer.queuedRefs[id]++
+	tracer.queuedBytes += bytes
+
+	if tracer.maxBatchSize != 0 && tracer.queuedReport.Size == tracer.maxBatchSize {
+		// notify the worker without blocking, a pending notification is enough. Only reaching the size notifies
+		// because the queue stays above it while the reports fail to send
+		select {
+		case tracer.batchFull <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// operationQueueBytes is the amount of bytes queueing the operation with the given ID adds to the queue. Only the info
+// and the fields provided through variables, which are returned too, are added when the operation is already queued.
+// Must be called while holding the queue lock.
+func (tracer *Tracer) operationQueueBytes(id string, operation *Operation) (added []string, bytes int) {
+	if _, exists := tracer.queuedReport.Operations[id]; !exists {
+		return nil, operationInfoBytes + operationBytes(operation)
+	}
+	added = tracer.newQueuedFields(id, operation.Fields)
+	bytes = operationInfoBytes
+	for _, field := range added {
+		bytes += len(field)
+	}
+	return added, bytes
+}
+
+// newQueuedFields returns the fields that the queued operation with the given ID doesn't have yet. The set of the
+// queued fields is created the first time something needs to be merged. Must be called while holding the queue lock.
+func (tracer *Tracer) newQueuedFields(id string, fields []string) []string {
+	queued := tracer.queuedReport.Operations[id]
+	if sameFields(queued.Fields, fields) {
+		// the cached fields of the operation, no fields were provided through variables
+		return nil
+	}
+	set, ok := tracer.queuedFields[id]
+	if !ok {
+		set = make(map[string]struct{}, len(queued.Fields))
+		for _, field := range queued.Fields {
+			set[field] = struct{}{}
+		}
+		tracer.queuedFields[id] = set
+	}
+	var added []string
+	for _, field := range fields {
+		if _, ok := set[field]; !ok {
+			added = append(added, field)
+		}
+	}
+	return added
+}
+
+// addQueuedFields adds the fields returned by [Tracer.newQueuedFields] to the queued operation with the given ID.
+// Must be called while holding the queue lock.
+func (tracer *Tracer) addQueuedFields(id string, added []string) {
+	if len(added) == 0 {
+		return
+	}
+	queued := tracer.queuedReport.Operations[id]
+	// clipped because the fields may be shared with the cache or with a report being sent
+	queued.Fields = append(slices.Clip(queued.Fields), added...)
+	for _, field := range added {
+		tracer.queuedFields[id][field] = struct{}{}
+	}
+}
+
+// sameFields checks whether both fields are the same slice.
+func sameFields(fields, other []string) bool {
+	return len(fields) == len(other) && (len(fields) == 0 || &fields[0] == &other[0])
+}
+
+// operationInfoBytes approximates the memory used by a single [OperationInfo] in the queue.
+const operationInfoBytes = 128
+
+// operationBytes approximates the memory used by the operation in the queue.
+func operationBytes(operation *Operation) int {
+	bytes := len(operation.Operation) + len(operation.OperationName)
+	for _, field := range operation.Fields {
+		bytes += len(field)
+	}
+	return bytes
+}
+
+// queueFull checks whether the queue would go over its limits when adding the
+// given amount of operations and bytes. Must be called while holding the queue lock.
+func (tracer *Tracer) queueFull(operations uint, bytes int) bool {
+	if tracer.maxQueuedOperations != 0 && tracer.queuedReport.Size+operations > tracer.maxQueuedOperations {
+		return true
+	}
+	if tracer.maxQueuedBytes != 0 && uint(tracer.queuedBytes+bytes) > tracer.maxQueuedBytes {
+		return true
+	}
+	return false
+}
+
+// dropQueuedOperations drops queued operations following the drop policy until there is
+// room for the given amount of operations and bytes. Subscription operations are dropped
+// only once there are no other operations left. Must be called while holding the queue lock.
+func (tracer *Tracer) dropQueuedOperations(operations uint, bytes int) {
+	for tracer.queuedReport.Size > 0 && tracer.queueFull(operations, bytes) {
+		if len(tracer.queuedReport.OperationInfos) > 0 {
+			tracer.queuedReport.OperationInfos = dropInfos(tracer, tracer.queuedReport.OperationInfos)
+		} else {
+			tracer.queuedReport.SubscriptionOperationInfos = dropInfos(tracer, tracer.queuedReport.SubscriptionOperationInfos)
+		}
+	}
+}
+
+// queuedInfo is the info of a queued operation.
+type queuedInfo interface {
+	operationMapKey() string
+}
+
+func (info *OperationInfo) operationMapKey() string { return info.ID }
+
+func (info *SubscriptionOperationInfo) operationMapKey() string { return info.ID }
+
+// dropInfos drops infos following the drop policy and returns the kept ones.
+// Must be called while holding the queue lock.
+func dropInfos[Info queuedInfo](tracer *Tracer, infos []Info) []Info {
+	switch tracer.dropPolicy {
+	case DropOldest:
+		tracer.forgetQueuedOperation(infos[0].operationMapKey())
+		return infos[1:]
+	case DropSample:
+		// a random operation makes room for the incoming one in the sample
+		i := rand.IntN(len(infos))
+		tracer.forgetQueuedOperation(infos[i].operationMapKey())
+		return slices.Delete(infos, i, i+1)
+	default: // DropNewest
+		tracer.forgetQueuedOperation(infos[len(infos)-1].operationMapKey())
+		return infos[:len(infos)-1]
+	}
+}
+
+// forgetQueuedOperation accounts for the info of the operation with the given ID being removed from the queue.
+// The operation is removed too if no other info references it. Must be called while holding the queue lock.
+func (tracer *Tracer) forgetQueuedOperation(id string) {
+	tracer.queuedReport.Size--
+	tracer.queuedBytes -= operationInfoBytes
+	tracer.queuedRefs[id]--
+	if tracer.queuedRefs[id] == 0 {
+		tracer.queuedBytes -= operationBytes(tracer.queuedReport.Operations[id])
+		delete(tracer.queuedReport.Operations, id)
+		delete(tracer.queuedRefs, id)
+		delete(tracer.queuedFields, id)
+	}
+	tracer.droppedOperations.Add(1)
+}
+
+// DroppedOperations returns the total number of operations dropped because the queue was full.
+func (tracer *Tracer) DroppedOperations() uint64 {
+	return tracer.droppedOperations.Load()
+}
+
+// startWorker starts the background worker, once, if it hasn't been started already.
+func (tracer *Tracer) startWorker() {
+	tracer.workerOnce.Do(func() {
+		go tracer.work()
+	})
+}
+
+// work sends the queued report whenever the batch fills up or the send report timeout elapses.
+// It runs until the tracer is closed, after which [Tracer.Close] takes care of flushing.
+func (tracer *Tracer) work() {
+	ticker := time.NewTicker(tracer.sendReportTimeout)
+	defer ticker.Stop()
+
+	var failed bool
+	for {
+		select {
+		case <-ticker.C:
+		case <-tracer.batchFull:
+			if failed {
+				// after failing to send, full batches wait for the next tick too
+				continue
+			}
+		case <-tracer.closing:
+			return
+		}
+
+		// cancelled when closing the tracer takes too long
+		err := tracer.sendQueuedReport(tracer.ctx, sendInBackground)
+		failed = err != nil
+		if err != nil && !errors.Is(err, errSendingPaused) {
+			tracer.log.Printf("failed to send queued report: %v", err)
+		}
+	}
+}
+
+// errSendingPaused is returned while sending is paused as requested by the "Retry-After" header.
+var errSendingPaused = errors.New("report sending is paused as requested by Retry-After")
+
+// sendMode decides how sending the queued report deals with failures.
+type sendMode int
+
+const (
+	// sendSynchronous makes a single attempt because the request waits for the sending.
+	sendSynchronous sendMode = iota
+	// sendInBackground retries following the retry policy.
+	sendInBackground
+	// sendFlushing retries following the retry policy and waits for the pause requested by "Retry-After" to pass.
+	sendFlushing
+)
+
+// sendQueuedReport sends the queued operations, in batches of at most the max batch size, while retrying on failures
+// unless sending synchronously. Reports that fail to send with a retryable error are put back into the queue and the
+// sending stops. While sending is paused as requested by "Retry-After", only flushing waits for the pause to pass or
+// the context to expire, the other modes stop right away.
+func (tracer *Tracer) sendQueuedReport(ctx context.Context, mode sendMode) error {
+	// report sending is serialized so that flushing can wait for in-flight sends
+	tracer.sendMtx.Lock()
+	defer tracer.sendMtx.Unlock()
+
+	if dropped := tracer.droppedOperations.Load(); dropped != tracer.droppedOperationsLogged {
+		tracer.log.Printf("dropped %d operations because the queue is full", dropped-tracer.droppedOperationsLogged)
+		tracer.droppedOperationsLogged = dropped
+	}
+
+	// the window of the field metrics ends even if there is nothing to send
+	fieldMetrics := tracer.takeFieldMetrics()
+	if fieldMetrics != nil && tracer.fieldMetricsHandler != nil {
+		tracer.fieldMetricsHandler(fieldMetrics)
+	}
+
+	if pause := time.Until(tracer.sendPausedUntil); pause > 0 {
+		if mode != sendFlushing {
+			return fmt.Errorf("%w until %s", errSendingPaused, tracer.sendPausedUntil.Format(time.RFC3339))
+		}
+		timer := time.NewTimer(pause)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%w until %s: %w", errSendingPaused, tracer.sendPausedUntil.Format(time.RFC3339), ctx.Err())
+		}
+	}
+
+	for {
+		report := tracer.takeQueuedReport()
+		if tracer.sendReportTimeout > 0 {
+			// every report starts a new sampling window
+			tracer.resetSamplingWindow()
+		}
+		if report == nil {
+			// nothing (left) to send
+			return nil
+		}
+		if fieldMetrics != nil && tracer.fieldMetricsInReport && report.Extensions == nil {
+			// requeued reports keep the metrics of their window, the current one goes with the next report
+			report.Extensions = &ReportExtensions{FieldMetrics: fieldMetrics}
+			fieldMetrics = nil
+		}
+
+		err := tracer.sendReportWithRetry(ctx, report, mode != sendSynchronous)
+		if err != nil {
+			if !isPermanentSendReportError(err) {
+				tracer.requeueReport(report)
+			}
+			return err
+		}
+	}
+}
+
+// sendReportWithRetry sends the report following the retry policy, or only once when retrying is disabled.
+func (tracer *Tracer) sendReportWithRetry(ctx context.Context, report *Report, retry bool) error {
+	maxAttempts := tracer.retryPolicy.MaxAttempts
+	if !retry {
+		maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		err := tracer.sendReportAttempt(ctx, report)
+		if err == nil {
+			return nil
+		}
+		var sendErr *SendReportError
+		if errors.As(err, &sendErr) && sendErr.RetryAfter > 0 &&
+			(sendErr.RetryAfter > tracer.retryPolicy.MaxBackoff || attempt >= maxAttempts) {
+			// waiting here would hold up the sending, the report waits in the queue instead
+			tracer.sendPausedUntil = time.Now().Add(sendErr.RetryAfter)
+			return err
+		}
+		if attempt >= maxAttempts || isPermanentSendReportError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(tracer.retryPolicy.backoff(attempt, err)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// sendReportAttempt sends the report once, giving up after the send timeout.
+func (tracer *Tracer) sendReportAttempt(ctx context.Context, report *Report) error {
+	if tracer.sendTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tracer.sendTimeout)
+		defer cancel()
+	}
+	return tracer.sendReport(ctx, tracer.endpoint, tracer.target, tracer.token, report)
+}
+
+// takeQueuedReport takes the queued report out of the queue. Only the oldest operations fitting
+// the max batch size are taken when there are more, the rest is left in the queue.
+func (tracer *Tracer) takeQueuedReport() *Report {
+	tracer.queuedReportMtx.Lock()
+	defer tracer.queuedReportMtx.Unlock()
+
+	report := tracer.queuedReport
+	if report == nil || report.Size == 0 || tracer.maxBatchSize == 0 || report.Size <= tracer.maxBatchSize {
+		tracer.queuedReport = nil
+		tracer.queuedRefs = nil
+		tracer.queuedFields = nil
+		tracer.queuedBytes = 0
+		tracer.takenSeen = tracer.queuedSeen
+		tracer.queuedSeen = 0
+		if report != nil && report.Size == 0 {
+			// everything got dropped
+			return nil
+		}
+		return report
+	}
+
+	batch := &Report{
+		Operations: map[string]*Operation{},
+		Extensions: report.Extensions,
+	}
+	report.Extensions = nil
+	take := int(tracer.maxBatchSize)
+	for len(report.OperationInfos) > 0 && len(batch.OperationInfos) < take {
+		batch.OperationInfos = append(batch.OperationInfos, report.OperationInfos[0])
+		report.OperationInfos = report.OperationInfos[1:]
+	}
+	for len(report.SubscriptionOperationInfos) > 0 && len(batch.OperationInfos)+len(batch.SubscriptionOperationInfos) < take {
+		batch.SubscriptionOperationInfos = append(batch.SubscriptionOperationInfos, report.SubscriptionOperationInfos[0])
+		report.SubscriptionOperationInfos = report.SubscriptionOperationInfos[1:]
+	}
+	batch.Size = tracer.maxBatchSize
+	// every queued operation stands for the same number of seen ones
+	tracer.takenSeen = tracer.queuedSeen * batch.Size / report.Size
+	tracer.queuedSeen -= tracer.takenSeen
+	report.Size -= batch.Size
+
+	takeOperation := func(id string) {
+		if _, ok := batch.Operations[id]; !ok {
+			// copied because operations left in the queue can still get their fields merged while sending
+			operation := *report.Operations[id]
+			batch.Operations[id] = &operation
+		}
+		tracer.queuedBytes -= operationInfoBytes
+		tracer.queuedRefs[id]--
+		if tracer.queuedRefs[id] == 0 {
+			tracer.queuedBytes -= operationBytes(report.Operations[id])
+			delete(report.Operations, id)
+			delete(tracer.queuedRefs, id)
+			delete(tracer.queuedFields, id)
+		}
+	}
+	for _, info := range batch.OperationInfos {
+		takeOperation(info.ID)
+	}
+	for _, info := range batch.SubscriptionOperationInfos {
+		takeOperation(info.ID)
+	}
+	return batch
+}
+
+func (tracer *Tracer) requeueReport(report *Report) {
+	tracer.queuedReportMtx.Lock()
+	defer tracer.queuedReportMtx.Unlock()
+
+	queued := tracer.queuedReport
+	tracer.queuedReport = report
+	tracer.queuedSeen += tracer.takenSeen
+	tracer.takenSeen = 0
+	tracer.queuedRefs = map[string]uint{}
+	tracer.queuedFields = map[string]map[string]struct{}{}
+	tracer.queuedBytes = 0
+	for _, operation := range report.Operations {
+		tracer.queuedBytes += operationBytes(operation)
+	}
+	for _, info := range report.OperationInfos {
+		tracer.queuedRefs[info.ID]++
+	}
+	for _, info := range report.SubscriptionOperationInfos {
+		tracer.queuedRefs[info.ID]++
+	}
+	tracer.queuedBytes += int(report.Size) * operationInfoBytes
+
+	if queued != nil {
+		// the requeued operations are older, they go first
+		for id, operation := range queued.Operations {
+			if _, exists := report.Operations[id]; !exists {
+				report.Operations[id] = operation
+				tracer.queuedBytes += operationBytes(operation)
+				continue
+			}
+			added := tracer.newQueuedFields(id, operation.Fields)
+			for _, field := range added {
+				tracer.queuedBytes += len(field)
+			}
+			tracer.addQueuedFields(id, added)
+		}
+		for _, info := range queued.OperationInfos {
+			tracer.queuedRefs[info.ID]++
+		}
+		for _, info := range queued.SubscriptionOperationInfos {
+			tracer.queuedRefs[info.ID]++
+		}
+		report.Size += queued.Size
+		report.OperationInfos = append(report.OperationInfos, queued.OperationInfos...)
+		report.SubscriptionOperationInfos = append(report.SubscriptionOperationInfos, queued.SubscriptionOperationInfos...)
+		tracer.queuedBytes += int(queued.Size) * operationInfoBytes
+	}
+
+	if tracer.queueFull(0, 0) {
+		tracer.dropQueuedOperations(0, 0)
+	}
+}
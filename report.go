@@ -18,6 +18,16 @@ type Report struct {
 	Operations map[string]*Operation `json:"map"`
 	// Info about each operation's execution
 	OperationInfos []*OperationInfo `json:"operations"`
+	// Info about each subscription operation's start
+	SubscriptionOperationInfos []*SubscriptionOperationInfo `json:"subscriptionOperations,omitempty"`
+	// Data reported next to the operations
+	Extensions *ReportExtensions `json:"extensions,omitempty"`
+}
+
+type ReportExtensions struct {
+	// Metrics of the fields resolved since the previous report, keyed by their schema coordinates
+	// e.g. {"Query.me": {"calls": 1, "errors": 0, "p50": 1024000, "p95": 1024000, "p99": 1024000}}
+	FieldMetrics map[string]FieldMetric `json:"fieldMetrics,omitempty"`
 }
 
 type Operation struct {
@@ -41,6 +51,14 @@ type OperationInfo struct {
 	Metadata  Metadata  `json:"metadata"`
 }
 
+type SubscriptionOperationInfo struct {
+	// The ID of the subscription operation in the operations map
+	ID string `json:"operationMapKey"`
+	// UNIX time in miliseconds of the subscription operation's start
+	Timestamp int64    `json:"timestamp"`
+	Metadata  Metadata `json:"metadata"`
+}
+
 type Execution struct {
 	// Was the execution successful?
 	Ok bool `json:"ok"`
@@ -70,6 +88,8 @@ func ContextWithOperation(ctx context.Context, operation *OperationWithInfo) con
 	return context.WithValue(ctx, &operationCtxKey, operation)
 }
 
+// OperationFromContext returns the operation being traced. The operation's execution is updated
+// by the tracer once the response is ready, resolvers must therefore treat it as read-only.
 func OperationFromContext(ctx context.Context) (operation *OperationWithInfo, exists bool) {
 	operationVal := ctx.Value(&operationCtxKey)
 	if operationVal == nil {
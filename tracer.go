@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand/v2"
+	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,23 +17,91 @@ import (
 	"github.com/domonda/go-types/nullable"
 	"github.com/domonda/go-types/uu"
 	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/formatter"
+	"github.com/vektah/gqlparser/v2/parser"
 )
 
 type Tracer struct {
-	target            string
-	token             string
-	endpoint          string
-	generateID        GenerateID
-	sendReportTimeout time.Duration
-	sendReport        SendReport
-	log               Logger
+	target                  string
+	token                   string
+	endpoint                string
+	generateID              GenerateID
+	sendReportTimeout       time.Duration
+	sendTimeout             time.Duration
+	sendReport              SendReport
+	retryPolicy             RetryPolicy
+	maxBatchSize            uint
+	maxQueuedOperations     uint
+	maxQueuedBytes          uint
+	dropPolicy              DropPolicy
+	fieldsCacheSize         int
+	conditionalFields       ConditionalFields
+	fieldMetricsEnabled     bool
+	fieldMetricsHandler     FieldMetricsHandler
+	fieldMetricsInReport    bool
+	compression             Compression
+	compressionMinSize      int
+	httpClient              *http.Client
+	requestHook             RequestHook
+	clientNameHeader        string
+	clientVersionHeader     string
+	clientInfo              ClientInfo
+	sampler                 Sampler
+	excludes                []Exclude
+	excludeIntrospection    bool
+	reportInvalidOperations bool
+	normalizeOperations     bool
+	privacyPolicy           PrivacyPolicy
+	log                     Logger
+
+	queuedReport    *Report
+	queuedRefs      map[string]uint
+	queuedFields    map[string]map[string]struct{}
+	queuedBytes     int
+	queuedReportMtx sync.Mutex
+	sendMtx         sync.Mutex
+	// sendPausedUntil is when sending can resume as requested by "Retry-After", guarded by sendMtx
+	sendPausedUntil time.Time
+	batchFull       chan struct{}
+	workerOnce      sync.Once
+
+	// keys of the sampled operations seen in the current sampling window
+	sampled      map[string]struct{}
+	sampledSince time.Time
+	sampledMtx   sync.Mutex
+
+	droppedOperations       atomic.Uint64
+	droppedOperationsLogged uint64
+
+	// number of operations the queued ones are a sample of, and the part of them taken for
+	// sending which is given back when the report gets requeued. Guarded by queuedReportMtx
+	queuedSeen uint
+	takenSeen  uint
+
+	fieldsCache *fieldsCache
+
+	// fieldMetrics of the current flush window, swapped when a report is sent. Recording holds the read
+	// lock so that swapping waits for in-flight records
+	fieldMetrics    *fieldMetrics
+	fieldMetricsMtx sync.RWMutex
+
+	// schema is set when the tracer gets validated by the server
+	schema *ast.Schema
+
+	// ctx lives as long as the tracer, cancelling it aborts in-flight report sending
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closed    atomic.Bool
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
 var _ interface {
 	graphql.HandlerExtension
+	graphql.OperationInterceptor
 	graphql.ResponseInterceptor
 	graphql.FieldInterceptor
-} = Tracer{}
+} = &Tracer{}
 
 // NewTracer creates a new Hive Console tracer with the given [target] and access [token].
 // Read more about it here: https://the-guild.dev/graphql/hive/docs/schema-registry/usage-reporting.
@@ -39,25 +110,44 @@ var _ interface {
 //   - token: Is the access token for the given [target]. Instructions about setting up access tokens can be found in the Hive Console Access Tokens documentation: https://the-guild.dev/graphql/hive/docs/management/access-tokens.
 func NewTracer(target, token string, opts ...TracerOption) *Tracer {
 	tracer := &Tracer{
-		target:            target,
-		token:             token,
-		endpoint:          defaultEndpoint,
-		generateID:        defaultGenerateID,
-		sendReportTimeout: defaultSendReportTimeout,
-		sendReport:        defaultSendReport,
-		log:               defaultLogger,
+		target:              target,
+		token:               token,
+		endpoint:            defaultEndpoint,
+		sendReportTimeout:   defaultSendReportTimeout,
+		sendTimeout:         defaultSendTimeout,
+		retryPolicy:         defaultRetryPolicy,
+		maxBatchSize:        defaultMaxBatchSize,
+		maxQueuedOperations: defaultMaxQueuedOperations,
+		fieldsCacheSize:     defaultFieldsCacheSize,
+		compressionMinSize:  defaultCompressionMinSize,
+		httpClient:          http.DefaultClient,
+		clientNameHeader:    defaultClientNameHeader,
+		clientVersionHeader: defaultClientVersionHeader,
+		log:                 defaultLogger,
+		batchFull:           make(chan struct{}, 1),
+		closing:             make(chan struct{}),
 	}
+	tracer.ctx, tracer.cancel = context.WithCancel(context.Background())
 	for _, opt := range opts {
 		opt.set(tracer)
 	}
+	if tracer.sendReport == nil {
+		tracer.sendReport = tracer.defaultSendReport
+	}
+	if tracer.fieldsCacheSize > 0 {
+		tracer.fieldsCache = newFieldsCache(tracer.fieldsCacheSize)
+	}
+	tracer.fieldMetrics = &fieldMetrics{}
 	return tracer
 }
 
-func (tracer Tracer) ExtensionName() string {
+func (tracer *Tracer) ExtensionName() string {
 	return "GraphQLHive"
 }
 
-func (tracer Tracer) Validate(schema graphql.ExecutableSchema) error {
+func (tracer *Tracer) Validate(schema graphql.ExecutableSchema) error {
+	tracer.schema = schema.Schema()
+
 	invalidTargetErr := fmt.Errorf("invalid gqlhive tracer target %q, must be a valid pathname <ORGANIZATION>/<PROJECT>/<TARGET> or an UUID <TARGET_ID>", tracer.target)
 
 	u, _ := url.Parse(tracer.target)
@@ -85,220 +175,638 @@ func (tracer Tracer) Validate(schema graphql.ExecutableSchema) error {
 		return errors.New("gqlhive tracer token must not be empty")
 	}
 
+	switch tracer.compression {
+	case CompressionNone, CompressionGzip:
+	default:
+		return fmt.Errorf("unsupported gqlhive tracer compression %q, must be %q or %q", tracer.compression, CompressionNone, CompressionGzip)
+	}
+
 	return nil
 }
 
 // InterceptResponse intercepts the incoming request.
-func (tracer Tracer) InterceptResponse(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+func (tracer *Tracer) InterceptResponse(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
 	if !graphql.HasOperationContext(ctx) {
 		return next(ctx)
 	}
+	if tracer.closed.Load() {
+		return next(ctx)
+	}
 	operationCtx := graphql.GetOperationContext(ctx)
 	if operationCtx.Operation == nil {
+		// operation failed parsing or validation
+		if tracer.reportInvalidOperations {
+			return tracer.interceptInvalidOperation(ctx, operationCtx, next)
+		}
+		return next(ctx)
+	}
+	if operationCtx.Operation.Operation == ast.Subscription {
+		// subscriptions are reported when intercepting the operation
+		return next(ctx)
+	}
+
+	if tracer.excluded(operationCtx) {
+		return next(ctx)
+	}
+
+	key := fieldsCacheKey(operationCtx, tracer.conditionalFields)
+	document, id, fields := tracer.reportedOperation(operationCtx, key)
+	operationName := nullable.TrimmedStringFrom(operationCtx.OperationName)
+	if !tracer.sample(ctx, operationCtx, key) {
 		return next(ctx)
 	}
 
 	operationStart := operationCtx.Stats.OperationStart
 	operation := &OperationWithInfo{
 		Operation: Operation{
-			Operation:     operationCtx.RawQuery,
-			OperationName: nullable.TrimmedStringFrom(operationCtx.OperationName),
-			Fields:        createFieldsForOperation(operationCtx.Operation.SelectionSet),
+			Operation:     document,
+			OperationName: operationName,
+			Fields:        fields,
 		},
 		OperationInfo: OperationInfo{
-			ID:        tracer.generateID(operationCtx.RawQuery, nullable.TrimmedStringFrom(operationCtx.OperationName)),
+			ID:        id,
 			Timestamp: operationStart.UnixMilli(),
 			Execution: Execution{
-				// we assume there are no errors, error checks will happen while intercepting fields
+				// we assume there are no errors, error checks will happen once the response is ready
 				Ok:          true,
 				ErrorsTotal: 0,
 			},
 			Metadata: Metadata{
-				Client: Client{
-					Name:    CLIENT_NAME,
-					Version: CLIENT_VERSION,
-				},
+				Client: tracer.clientForOperation(ctx, operationCtx),
 			},
 		},
 	}
 	defer func() {
 		operation.Execution.Duration = time.Since(operationStart).Nanoseconds()
 
-		err := queueOperation(operation)
+		err := tracer.queueOperation(operation)
 		if err != nil {
 			tracer.log.Printf("failed to queue operation %q: %v", operation.ID, err)
 			return
 		}
 
-		// TODO: implement send retry
+		tracer.scheduleSending(ctx, operation.ID)
+	}()
+
+	res := next(ContextWithOperation(ctx, operation))
+	if res != nil && len(res.Errors) != 0 {
+		// the response contains all errors, including field errors and recovered panics
+		operation.Execution.Ok = false
+		operation.Execution.ErrorsTotal = len(res.Errors)
+	}
+	return res
+}
+
+// documentForOperation creates the reported document containing only the operation with the given name
+// and the fragments it uses. Queries that cannot be parsed are reported as is, unless the privacy policy says otherwise.
+func (tracer *Tracer) documentForOperation(query, operationName string) string {
+	var document string
+	doc, err := operationDocument(query, operationName)
+	switch {
+	case err == nil:
+		if tracer.normalizeOperations {
+			normalizeDocument(doc)
+		}
+		tracer.privacyPolicy.apply(doc)
+		if tracer.normalizeOperations || tracer.privacyPolicy.DropComments {
+			document = printDocument(doc)
+		} else {
+			document = printDocument(doc, formatter.WithComments())
+		}
+	case tracer.privacyPolicy.rewritesDocument():
+		// the query must not be reported as is
+		document = invalidOperationPlaceholder
+	default:
+		document = query
+	}
+	if tracer.privacyPolicy.HashDocument {
+		document = hashedDocument(document)
+	}
+	return document
+}
+
+// operationID generates the ID of the operation with the given reported document,
+// using the default generator when there is no custom one.
+func (tracer *Tracer) operationID(operationCtx *graphql.OperationContext, document string) string {
+	generateID := tracer.generateID
+	if generateID == nil {
+		generateID = defaultGenerateID
+	}
+	return generateID(tracer.documentForID(operationCtx.RawQuery, document), nullable.TrimmedStringFrom(operationCtx.OperationName))
+}
 
-		doSend := func(ctx context.Context) error {
-			queuedReportMtx.Lock()
-			defer queuedReportMtx.Unlock()
+// documentForID picks the document used for generating the operation ID. Normalized or rewritten
+// documents are used so that operations ending up with the same document share the ID, and so
+// that ID generators don't reveal anything the privacy policy hides.
+func (tracer *Tracer) documentForID(query, document string) string {
+	if tracer.normalizeOperations || tracer.privacyPolicy.rewritesDocument() || tracer.privacyPolicy.HashDocument {
+		return document
+	}
+	return query
+}
 
-			err := tracer.sendReport(ctx, tracer.endpoint, tracer.target, tracer.token, queuedReport)
-			if err != nil {
-				return err
-			}
+// invalidOperationPlaceholder is reported instead of operations that cannot be parsed.
+const invalidOperationPlaceholder = "# unparseable operation\n{ __typename }"
+
+// interceptInvalidOperation reports the operation that failed parsing or validation. Exclusions
+// and sampling are not applied because the operation is not known.
+func (tracer *Tracer) interceptInvalidOperation(ctx context.Context, operationCtx *graphql.OperationContext, next graphql.ResponseHandler) *graphql.Response {
+	res := next(ctx)
+
+	document := operationCtx.RawQuery
+	if _, err := parser.ParseQuery(&ast.Source{Input: document}); err != nil || document == "" {
+		document = invalidOperationPlaceholder
+	} else {
+		document = tracer.documentForOperation(document, operationCtx.OperationName)
+	}
+	operationName := nullable.TrimmedStringFrom(operationCtx.OperationName)
+	operation := &OperationWithInfo{
+		Operation: Operation{
+			Operation:     document,
+			OperationName: operationName,
+			Fields:        []string{},
+		},
+		OperationInfo: OperationInfo{
+			ID:        tracer.operationID(operationCtx, document),
+			Timestamp: operationCtx.Stats.OperationStart.UnixMilli(),
+			Execution: Execution{
+				Ok:       false,
+				Duration: time.Since(operationCtx.Stats.OperationStart).Nanoseconds(),
+			},
+			Metadata: Metadata{
+				Client: tracer.clientForOperation(ctx, operationCtx),
+			},
+		},
+	}
+	if res != nil {
+		operation.Execution.ErrorsTotal = len(res.Errors)
+		tracer.log.Printf("invalid operation %q from client %s@%s: %v", operation.ID, operation.Metadata.Client.Name, operation.Metadata.Client.Version, res.Errors)
+	}
+
+	err := tracer.queueOperation(operation)
+	if err != nil {
+		tracer.log.Printf("failed to queue operation %q: %v", operation.ID, err)
+		return res
+	}
+	tracer.scheduleSending(ctx, operation.ID)
+
+	return res
+}
+
+// InterceptOperation intercepts the start of the operation and reports subscriptions.
+// Subscriptions are reported once when starting, regardless of the amount of events.
+func (tracer *Tracer) InterceptOperation(ctx context.Context, next graphql.OperationHandler) graphql.ResponseHandler {
+	if tracer.closed.Load() {
+		return next(ctx)
+	}
+	operationCtx := graphql.GetOperationContext(ctx)
+	if operationCtx.Operation == nil || operationCtx.Operation.Operation != ast.Subscription {
+		// other operations are reported when intercepting the response
+		return next(ctx)
+	}
+
+	if tracer.excluded(operationCtx) {
+		return next(ctx)
+	}
+
+	key := fieldsCacheKey(operationCtx, tracer.conditionalFields)
+	document, id, fields := tracer.reportedOperation(operationCtx, key)
+	operationName := nullable.TrimmedStringFrom(operationCtx.OperationName)
+	if !tracer.sample(ctx, operationCtx, key) {
+		return next(ctx)
+	}
 
-			// clear queued report
-			queuedReport = nil
-			return nil
+	operation := &Operation{
+		Operation:     document,
+		OperationName: operationName,
+		Fields:        fields,
+	}
+	info := &SubscriptionOperationInfo{
+		ID:        id,
+		Timestamp: operationCtx.Stats.OperationStart.UnixMilli(),
+		Metadata: Metadata{
+			Client: tracer.clientForOperation(ctx, operationCtx),
+		},
+	}
+	err := tracer.queueSubscriptionOperation(operation, info)
+	if err != nil {
+		tracer.log.Printf("failed to queue subscription operation %q: %v", id, err)
+	} else {
+		tracer.scheduleSending(ctx, id)
+	}
+
+	return next(ctx)
+}
+
+// scheduleSending sends the queued report right away when synchronous,
+// otherwise the report is batched and sent in the background.
+func (tracer *Tracer) scheduleSending(ctx context.Context, id string) {
+	// synchronous, negative timeouts included
+	if tracer.sendReportTimeout <= 0 {
+		err := tracer.sendQueuedReport(ctx, sendSynchronous)
+		if err != nil && !errors.Is(err, errSendingPaused) {
+			tracer.log.Printf("failed to send report for operation %q: %v", id, err)
 		}
+		return
+	}
 
-		// synchronous
-		if tracer.sendReportTimeout == 0 {
-			err := doSend(ctx)
-			if err != nil {
-				tracer.log.Printf("failed to send report for operation %q: %v", operation.ID, err)
-			}
-			return
+	// batched in the background
+	tracer.startWorker()
+}
+
+// excluded checks whether the operation is excluded from reporting.
+func (tracer *Tracer) excluded(operationCtx *graphql.OperationContext) bool {
+	if tracer.excludeIntrospection && isIntrospection(operationCtx.Operation.SelectionSet) {
+		return true
+	}
+	for _, exclude := range tracer.excludes {
+		if exclude(operationCtx) {
+			return true
 		}
+	}
+	return false
+}
 
-		// debounced
-		if sendingQueued.CompareAndSwap(false, true) {
-			go func() {
-				defer sendingQueued.Store(false)
-				time.Sleep(tracer.sendReportTimeout)
-
-				err := doSend(
-					// may time out and get cancelled
-					// TODO: use a context with deadline
-					context.TODO(),
-				)
-				if err != nil {
-					tracer.log.Printf("failed to send queued report for operation %q: %v", operation.ID, err)
-				}
-			}()
+// isIntrospection checks whether the selection set queries introspection fields only.
+func isIntrospection(selSet ast.SelectionSet) bool {
+	for _, sel := range selSet {
+		switch sel := sel.(type) {
+		case *ast.Field:
+			if !strings.HasPrefix(sel.Name, "__") {
+				return false
+			}
+		case *ast.FragmentSpread:
+			if !isIntrospection(sel.Definition.SelectionSet) {
+				return false
+			}
+		case *ast.InlineFragment:
+			if !isIntrospection(sel.SelectionSet) {
+				return false
+			}
 		}
-	}()
+	}
+	return true
+}
 
-	return next(ContextWithOperation(ctx, operation))
+// sample decides whether the operation should be reported. Operations that are not reported yet in the
+// current sampling window are always reported so that each unique operation makes it into the reports.
+// Operations are told apart by the given key of their document and name, see [fieldsCacheKey], instead
+// of their IDs which could be generated per execution.
+func (tracer *Tracer) sample(ctx context.Context, operationCtx *graphql.OperationContext, key string) bool {
+	if tracer.sampler == nil {
+		return true
+	}
+	first := tracer.firstInSamplingWindow(key)
+	rate := tracer.sampler(ctx, operationCtx)
+	return first || rate >= 1 || rand.Float64() < rate
 }
 
-func (tracer Tracer) InterceptField(ctx context.Context, next graphql.Resolver) (interface{}, error) {
-	fieldCtx := graphql.GetFieldContext(ctx)
+// firstInSamplingWindow checks whether the operation with the given key is seen for the first time in the current
+// sampling window and marks it as seen. The window lasts as long as the send report timeout, or the default one
+// when sending synchronously, and restarts early when a report is sent.
+func (tracer *Tracer) firstInSamplingWindow(key string) bool {
+	tracer.sampledMtx.Lock()
+	defer tracer.sampledMtx.Unlock()
 
-	operation, exists := OperationFromContext(ctx)
-	if !exists {
-		return nil, errors.New("operation doesn't exist in context")
+	window := tracer.sendReportTimeout
+	if window <= 0 {
+		window = defaultSendReportTimeout
+	}
+	if tracer.sampled == nil || time.Since(tracer.sampledSince) >= window {
+		tracer.sampled = map[string]struct{}{}
+		tracer.sampledSince = time.Now()
+	}
+	if _, ok := tracer.sampled[key]; ok {
+		return false
 	}
+	tracer.sampled[key] = struct{}{}
+	return true
+}
 
-	res, err := next(ctx)
-	if err != nil {
-		operation.Execution.Ok = false
-		operation.Execution.ErrorsTotal += 1
+// resetSamplingWindow starts a new sampling window.
+func (tracer *Tracer) resetSamplingWindow() {
+	tracer.sampledMtx.Lock()
+	defer tracer.sampledMtx.Unlock()
+
+	tracer.sampled = nil
+}
+
+// clientForOperation detects the client executing the operation using the
+// custom client info, falling back to the request headers and then to the tracer itself.
+func (tracer *Tracer) clientForOperation(ctx context.Context, operationCtx *graphql.OperationContext) Client {
+	if tracer.clientInfo != nil {
+		if client := tracer.clientInfo(ctx); client != nil {
+			return *client
+		}
+	}
+	if name := operationCtx.Headers.Get(tracer.clientNameHeader); name != "" {
+		return Client{
+			Name:    name,
+			Version: operationCtx.Headers.Get(tracer.clientVersionHeader),
+		}
+	}
+	return Client{
+		Name:    CLIENT_NAME,
+		Version: CLIENT_VERSION,
 	}
+}
 
-	errList := graphql.GetFieldErrors(ctx, fieldCtx)
-	if len(errList) != 0 {
-		operation.Execution.Ok = false
-		operation.Execution.ErrorsTotal += len(errList)
+// Flush immediately sends all queued operations and waits for any in-flight report sending to complete.
+// When sending is paused as requested by the "Retry-After" header, the pause is waited out first.
+// If the context expires before, the context error is returned and the sending continues in the background.
+func (tracer *Tracer) Flush(ctx context.Context) error {
+	sent := make(chan error, 1)
+	go func() {
+		sent <- tracer.sendQueuedReport(ctx, sendFlushing)
+	}()
+	select {
+	case err := <-sent:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	return res, err
+// Close stops the tracer from tracing new operations and flushes the queued ones.
+// Closing is idempotent and is meant to be called after the GraphQL server has been
+// shut down (e.g. after [http.Server.Shutdown]) because operations finishing after
+// closing will not be reported. Report sending still in-flight when the context
+// expires gets cancelled.
+func (tracer *Tracer) Close(ctx context.Context) error {
+	tracer.closeOnce.Do(func() {
+		tracer.closed.Store(true)
+		close(tracer.closing)
+	})
+	err := tracer.Flush(ctx)
+	tracer.cancel()
+	return err
 }
 
-func createFieldsForOperation(rootSelectionSet ast.SelectionSet) (fields []string) {
+// createFieldsForOperation creates the schema coordinates used by the operation, without duplicates. Next to the
+// fields and their arguments, the coordinates contain the root type, the output and input types, the used enum
+// values and input fields, the arguments given a non-null value with a "!" suffix, and the used directives with
+// their arguments like "@include" and "@include(if:)". The schema is used for finding the types implementing
+// interfaces and can be nil when it's not known. Input fields and enum values provided through variables are not
+// part of the operation, see [createFieldsForVariables]. The variables are used only for evaluating the @skip and
+// @include directives following the policy. Definitions missing from the operation, like in operations that were
+// not validated, are skipped.
+func createFieldsForOperation(schema *ast.Schema, operation *ast.OperationDefinition, variables map[string]any, policy ConditionalFields) (fields []string) {
+	if operation == nil {
+		return nil
+	}
+	seen := map[string]struct{}{}
+	add := func(field string) {
+		if _, ok := seen[field]; ok || field == "" {
+			return
+		}
+		seen[field] = struct{}{}
+		fields = append(fields, field)
+	}
+	variableTypes := map[string]*ast.Type{}
+	for _, variable := range operation.VariableDefinitions {
+		variableTypes[variable.Variable] = variable.Type
+	}
+	// fragments are visited once because their fields are the same wherever they're spread
+	visitedFragments := map[string]struct{}{}
+
 	var visitField func(selSet ast.SelectionSet)
+	var visitArguments func(parent string, field *ast.Field)
+	var visitDirectives func(directives ast.DirectiveList) bool
 	var visitValue func(value *ast.Value)
 	visitField = func(selSet ast.SelectionSet) {
 		for _, sel := range selSet {
 			switch sel := sel.(type) {
 			case *ast.Field:
 				{
-					fields = append(fields,
-						fmt.Sprintf("%s.%s", sel.ObjectDefinition.Name, sel.Name),
-					)
-					for _, arg := range sel.Arguments {
-						fields = append(fields, fmt.Sprintf("%s.%s.%s", sel.ObjectDefinition.Name, sel.Name, arg.Name))
-						visitValue(arg.Value)
+					if !visitDirectives(sel.Directives) {
+						continue
+					}
+					if strings.HasPrefix(sel.Name, "__") {
+						// introspection fields, like __typename, are not part of the schema
+						continue
+					}
+					if sel.ObjectDefinition != nil {
+						add(sel.ObjectDefinition.Name)
+						add(fmt.Sprintf("%s.%s", sel.ObjectDefinition.Name, sel.Name))
+						visitArguments(sel.ObjectDefinition.Name, sel)
+						if sel.ObjectDefinition.Kind == ast.Interface && schema != nil {
+							// fields selected on interfaces are used on all types implementing them
+							for _, possibleType := range schema.GetPossibleTypes(sel.ObjectDefinition) {
+								add(possibleType.Name)
+								add(fmt.Sprintf("%s.%s", possibleType.Name, sel.Name))
+								visitArguments(possibleType.Name, sel)
+							}
+						}
+					}
+					if sel.Definition != nil {
+						// output type
+						add(typeName(sel.Definition.Type))
 					}
 					visitField(sel.SelectionSet)
 				}
 			case *ast.FragmentSpread:
 				{
+					if !visitDirectives(sel.Directives) || sel.Definition == nil {
+						continue
+					}
+					if _, ok := visitedFragments[sel.Name]; ok {
+						continue
+					}
+					visitedFragments[sel.Name] = struct{}{}
+					add(sel.Definition.TypeCondition)
+					visitDirectives(sel.Definition.Directives)
 					// skip directly to the fields of the fragment
 					visitField(sel.Definition.SelectionSet)
 				}
 			case *ast.InlineFragment:
 				{
+					if !visitDirectives(sel.Directives) {
+						continue
+					}
+					add(sel.TypeCondition)
 					// skip directly to the fields of the inline fragment
 					visitField(sel.SelectionSet)
 				}
 			}
 		}
 	}
+	visitArguments = func(parent string, field *ast.Field) {
+		for _, arg := range field.Arguments {
+			add(fmt.Sprintf("%s.%s.%s", parent, field.Name, arg.Name))
+			if nonNullValue(arg.Value, variableTypes) {
+				// arguments provided with a value, breaking changes making them required are safe
+				add(fmt.Sprintf("%s.%s.%s!", parent, field.Name, arg.Name))
+			}
+			visitValue(arg.Value)
+		}
+	}
+	visitDirectives = func(directives ast.DirectiveList) bool {
+		for _, directive := range directives {
+			add("@" + directive.Name)
+			for _, arg := range directive.Arguments {
+				add(fmt.Sprintf("@%s(%s:)", directive.Name, arg.Name))
+				visitValue(arg.Value)
+			}
+		}
+		return policy != ConditionalFieldsEvaluated || included(directives, variables)
+	}
 	visitValue = func(value *ast.Value) {
+		if value == nil || value.Definition == nil {
+			return
+		}
+		// input type
+		add(value.Definition.Name)
+
 		if len(value.Children) == 0 {
-			if value.Definition.Kind == ast.Enum {
-				// single enum
-				if value.Kind == ast.Variable {
-					// variable
-					for _, enum := range value.Definition.EnumValues {
-						fields = append(fields,
-							fmt.Sprintf("%s.%s", value.Definition.Name, enum.Name),
-						)
-					}
-				} else {
-					// hard-coded
-					fields = append(fields,
-						fmt.Sprintf("%s.%s", value.Definition.Name, value.Raw),
-					)
-				}
-			} else {
-				// single scalar
-				fields = append(fields,
-					value.Definition.Name,
-				)
+			if value.Kind == ast.EnumValue {
+				// single enum, the ones provided through variables are created from the variable values
+				add(fmt.Sprintf("%s.%s", value.Definition.Name, value.Raw))
 			}
 			return
 		}
 
 		for _, child := range value.Children {
-			if value.Definition.Kind == ast.Enum {
-				// list of enums
-				fields = append(fields,
-					fmt.Sprintf("%s.%s", value.Definition.Name, child.Value.Raw),
-				)
+			if value.Kind == ast.ListValue {
+				// list of inputs
+				visitValue(child.Value)
 				continue
 			}
 
 			// other type of inputs
-			fields = append(fields,
-				fmt.Sprintf("%s.%s", value.Definition.Name, child.Name),
-			)
+			add(fmt.Sprintf("%s.%s", value.Definition.Name, child.Name))
 			visitValue(child.Value)
 		}
 	}
-	visitField(rootSelectionSet)
+	visitDirectives(operation.Directives)
+	visitField(operation.SelectionSet)
+	for _, variable := range operation.VariableDefinitions {
+		// variable types, including the ones of unused variables
+		add(typeName(variable.Type))
+		visitValue(variable.DefaultValue)
+		visitDirectives(variable.Directives)
+	}
 	return fields
 }
 
-var (
-	queuedReport    *Report
-	queuedReportMtx sync.Mutex
-	sendingQueued   atomic.Bool
-)
+// included evaluates the @skip and @include directives against the variables. Conditions that
+// cannot be evaluated, like ones using missing variables, don't exclude anything.
+func included(directives ast.DirectiveList, variables map[string]any) bool {
+	condition := func(name string, fallback bool) bool {
+		directive := directives.ForName(name)
+		if directive == nil {
+			return fallback
+		}
+		arg := directive.Arguments.ForName("if")
+		if arg == nil || arg.Value == nil {
+			return fallback
+		}
+		value, err := arg.Value.Value(variables)
+		if err != nil {
+			return fallback
+		}
+		if value, ok := value.(bool); ok {
+			return value
+		}
+		return fallback
+	}
+	return !condition("skip", false) && condition("include", true)
+}
 
-func queueOperation(operation *OperationWithInfo) error {
-	queuedReportMtx.Lock()
-	defer queuedReportMtx.Unlock()
+// typeName returns the name of the named type, or an empty string when there is no type.
+func typeName(typ *ast.Type) string {
+	for typ != nil && typ.NamedType == "" {
+		typ = typ.Elem
+	}
+	if typ == nil {
+		return ""
+	}
+	return typ.NamedType
+}
 
-	if queuedReport == nil {
-		queuedReport = &Report{
-			Operations: map[string]*Operation{},
+// createFieldsForVariables creates the schema coordinates of the input fields and enum values provided through
+// the variables of the operation by walking the variable values against their types. Unlike the document, the
+// values differ between executions so the coordinates are created for every execution.
+func createFieldsForVariables(schema *ast.Schema, operation *ast.OperationDefinition, variables map[string]any) (fields []string) {
+	if schema == nil || operation == nil {
+		return nil
+	}
+	seen := map[string]struct{}{}
+	add := func(field string) {
+		if _, ok := seen[field]; ok || field == "" {
+			return
 		}
+		seen[field] = struct{}{}
+		fields = append(fields, field)
 	}
 
-	_, exists := queuedReport.Operations[operation.ID]
-	if exists {
-		return fmt.Errorf("operation with id %q already exists in report", operation.ID)
+	var visitValue func(def *ast.Definition, value any)
+	visitValue = func(def *ast.Definition, value any) {
+		if def == nil || value == nil {
+			return
+		}
+		if list, ok := value.([]any); ok {
+			// list of inputs
+			for _, item := range list {
+				visitValue(def, item)
+			}
+			return
+		}
+		switch def.Kind {
+		case ast.Enum:
+			if name, ok := value.(string); ok && def.EnumValues.ForName(name) != nil {
+				add(fmt.Sprintf("%s.%s", def.Name, name))
+			}
+		case ast.InputObject:
+			object, ok := value.(map[string]any)
+			if !ok {
+				return
+			}
+			// in the order of the definition because maps are not ordered
+			for _, field := range def.Fields {
+				fieldValue, ok := object[field.Name]
+				if !ok {
+					continue
+				}
+				add(fmt.Sprintf("%s.%s", def.Name, field.Name))
+				add(typeName(field.Type))
+				visitValue(schema.Types[typeName(field.Type)], fieldValue)
+			}
+		}
 	}
+	for _, variable := range operation.VariableDefinitions {
+		visitValue(schema.Types[typeName(variable.Type)], variables[variable.Variable])
+	}
+	return fields
+}
 
-	queuedReport.Size++
-	queuedReport.Operations[operation.ID] = &operation.Operation
-	queuedReport.OperationInfos = append(queuedReport.OperationInfos, &operation.OperationInfo)
+// mergeFields returns the fields together with the other fields that are not already in them. The fields are
+// returned as is when there is nothing to add, otherwise a new slice is created leaving the fields untouched.
+func mergeFields(fields, other []string) []string {
+	merged := fields
+	for _, field := range other {
+		if slices.Contains(fields, field) {
+			continue
+		}
+		if len(merged) == len(fields) {
+			merged = slices.Clone(fields)
+		}
+		merged = append(merged, field)
+	}
+	return merged
+}
 
-	return nil
+// nonNullValue checks whether the value is not null, variables are not null when their type is non-null.
+func nonNullValue(value *ast.Value, variableTypes map[string]*ast.Type) bool {
+	if value == nil {
+		return false
+	}
+	switch value.Kind {
+	case ast.NullValue:
+		return false
+	case ast.Variable:
+		variableType, ok := variableTypes[value.Raw]
+		return ok && variableType != nil && variableType.NonNull
+	default:
+		return true
+	}
 }
@@ -1,24 +1,39 @@
 package gqlhive
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/99designs/gqlgen/client"
+	"github.com/99designs/gqlgen/graphql"
 	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
 	"github.com/99designs/gqlgen/graphql/handler/transport"
 	"github.com/domonda/go-types/nullable"
 	"github.com/domonda/go-types/uu"
 	"github.com/enisdenjo/go-gqlhive/internal/fixtures/todos/graph"
 	"github.com/gkampitakis/go-snaps/snaps"
 	"github.com/stretchr/testify/require"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
 )
 
 func TestMain(t *testing.M) {
@@ -27,8 +42,6 @@ func TestMain(t *testing.M) {
 	os.Exit(v)
 }
 
-// TODO: test errored fields
-
 func TestInvalidTarget(t *testing.T) {
 	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
 
@@ -111,6 +124,21 @@ func TestInvalidTarget(t *testing.T) {
 	)
 }
 
+func TestInvalidCompression(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+
+	require.PanicsWithError(t,
+		"unsupported gqlhive tracer compression \"zstd\", must be \"\" or \"gzip\"",
+		func() {
+			srv.Use(NewTracer(
+				uu.IDv4().String(),
+				"<token>",
+				WithCompression("zstd"),
+			))
+		},
+	)
+}
+
 func TestCreatedReports(t *testing.T) {
 	var queries = []string{
 		"{ todos { id } }",
@@ -187,6 +215,33 @@ func TestCreatedReports(t *testing.T) {
 				id
 			}
 		}`,
+		`{
+			node(id: "t0") {
+				__typename
+				id
+				... on Todo {
+					text
+				}
+				... on User {
+					name
+				}
+			}
+		}`,
+		`{
+			search(text: "o") {
+				__typename
+				... on Node {
+					id
+				}
+				... on Todo {
+					text
+				}
+				...UserFragment
+			}
+		}
+		fragment UserFragment on User {
+			name
+		}`,
 	}
 
 	for _, query := range queries {
@@ -220,105 +275,371 @@ func TestCreatedReports(t *testing.T) {
 	}
 }
 
-func TestSendingQueuedReports(t *testing.T) {
+func TestErroredOperations(t *testing.T) {
+	tests := []struct {
+		query       string
+		ok          bool
+		errorsTotal int
+	}{
+		{
+			query: `mutation {
+				createTodo(input: { text: "Check Mail", userId: "u0" }) {
+					id
+				}
+			}`,
+			ok:          true,
+			errorsTotal: 0,
+		},
+		{
+			query: `mutation {
+				createTodo(input: { text: "Check Mail", userId: "nope" }) {
+					id
+				}
+			}`,
+			ok:          false,
+			errorsTotal: 1,
+		},
+		{
+			query: `mutation {
+				first: createTodo(input: { text: "Check Mail", userId: "nope" }) {
+					id
+				}
+				second: createTodo(input: { text: "Check Mail", userId: "nope" }) {
+					id
+				}
+			}`,
+			ok:          false,
+			errorsTotal: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+			srv.AddTransport(transport.POST{})
+
+			var sentReport *Report
+			srv.Use(NewTracer(
+				uu.IDv4().String(),
+				"<token>",
+				WithSendReportTimeout(0),
+				WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+					sentReport = report
+					return nil
+				}),
+			))
+
+			res := map[string]any{}
+			err := client.New(srv).Post(test.query, &res)
+			if test.errorsTotal == 0 {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+
+			require.Len(t, sentReport.OperationInfos, 1)
+			require.Equal(t, test.ok, sentReport.OperationInfos[0].Execution.Ok)
+			require.Equal(t, test.errorsTotal, sentReport.OperationInfos[0].Execution.ErrorsTotal)
+		})
+	}
+}
+
+func TestErroredFieldsInParallel(t *testing.T) {
 	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
 	srv.AddTransport(transport.POST{})
 
-	var wg sync.WaitGroup
-	wg.Add(1)
 	var sentReport *Report
 	srv.Use(NewTracer(
 		uu.IDv4().String(),
 		"<token>",
-		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
-			return operation
-		}),
-		WithSendReportTimeout(1*time.Second),
+		WithSendReportTimeout(0),
 		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
-			for _, info := range report.OperationInfos {
-				info.Timestamp = -1
-				info.Execution.Duration = -1
-			}
 			sentReport = report
-			wg.Done() // we also test the amount of SendReport calles here because calling wg.Done too many times will panic
 			return nil
 		}),
 	))
 
-	res := map[string]any{}
-	client.New(srv).MustPost("{ todos { id } } #1", &res)
-	client.New(srv).MustPost("{ todos { id } } #2", &res)
-	client.New(srv).MustPost("{ todos { id } } #3", &res)
-	client.New(srv).MustPost("{ todos { id } } #4", &res)
+	query := "{ todos { id"
+	for i := range 50 {
+		query += fmt.Sprintf(" failing%d: failing", i)
+	}
+	query += " } }"
 
-	wg.Wait()
+	res, err := client.New(srv).RawPost(query)
+	require.NoError(t, err)
+	var errs []any
+	require.NoError(t, json.Unmarshal(res.Errors, &errs))
+	require.GreaterOrEqual(t, len(errs), 100) // at least 2 todos with 50 failing fields each
 
-	snaps.MatchJSON(t, sentReport)
+	require.Len(t, sentReport.OperationInfos, 1)
+	require.False(t, sentReport.OperationInfos[0].Execution.Ok)
+	require.Equal(t, len(errs), sentReport.OperationInfos[0].Execution.ErrorsTotal)
 }
 
-func TestSendingReportsOverHTTP(t *testing.T) {
-	target := uu.IDv4()
-	token := "sometoken123"
-	tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		res.WriteHeader(http.StatusOK)
+func TestFieldMetrics(t *testing.T) {
+	t.Run("report", func(t *testing.T) {
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
 
-		require.Equal(t, "/"+target.String(), req.URL.Path)
+		var handledMetrics map[string]FieldMetric
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithSendReportTimeout(time.Minute),
+			WithFieldMetrics(true),
+			WithFieldMetricsHandler(func(metrics map[string]FieldMetric) {
+				handledMetrics = metrics
+			}),
+			WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+				return nil
+			}),
+		)
+		srv.Use(tracer)
 
-		require.Equal(t, "POST", req.Method)
-		require.Equal(t, "application/json", req.Header.Get("Content-Type"))
-		require.Equal(t, fmt.Sprintf("Bearer %s", token), req.Header.Get("Authorization"))
-		require.Equal(t, "2", req.Header.Get("X-Usage-API-Version"))
+		// the errors of the failing fields are expected
+		todos := map[string][]any{}
+		client.New(srv).Post("{ todos { id failing __typename } }", &todos)
+		client.New(srv).Post("{ todos { id failing } }", &todos)
 
-		report := &Report{}
-		err := json.NewDecoder(req.Body).Decode(&report)
-		require.NoError(t, err)
+		metrics := tracer.FieldMetrics()
+		require.ElementsMatch(t, []string{"Query.todos", "Todo.id", "Todo.failing"}, slices.Collect(maps.Keys(metrics)))
+		require.Equal(t, uint64(2), metrics["Query.todos"].Calls)
+		require.Zero(t, metrics["Query.todos"].Errors)
+		require.Equal(t, uint64(2*len(todos["todos"])), metrics["Todo.id"].Calls)
+		require.Zero(t, metrics["Todo.id"].Errors)
+		require.Equal(t, uint64(2*len(todos["todos"])), metrics["Todo.failing"].Calls)
+		require.Equal(t, uint64(2*len(todos["todos"])), metrics["Todo.failing"].Errors)
+		for _, metric := range metrics {
+			require.Positive(t, metric.P50)
+			require.LessOrEqual(t, metric.P50, metric.P95)
+			require.LessOrEqual(t, metric.P95, metric.P99)
+		}
 
-		for _, info := range report.OperationInfos {
-			info.Timestamp = -1
-			info.Execution.Duration = -1
+		require.NoError(t, tracer.Flush(context.Background()))
+		require.Equal(t, metrics["Todo.failing"].Calls, handledMetrics["Todo.failing"].Calls)
+		require.Nil(t, tracer.FieldMetrics(), "new window after sending")
+
+		client.New(srv).Post("{ todos { id } }", &todos)
+		require.NoError(t, tracer.Flush(context.Background()))
+		require.Equal(t, uint64(1), handledMetrics["Query.todos"].Calls)
+	})
+
+	t.Run("in report", func(t *testing.T) {
+		for _, inReport := range []bool{true, false} {
+			t.Run(fmt.Sprint(inReport), func(t *testing.T) {
+				srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+				srv.AddTransport(transport.POST{})
+
+				var handledMetrics map[string]FieldMetric
+				var sentReports []*Report
+				tracer := NewTracer(
+					uu.IDv4().String(),
+					"<token>",
+					WithSendReportTimeout(time.Minute),
+					WithFieldMetrics(true),
+					WithFieldMetricsInReport(inReport),
+					WithFieldMetricsHandler(func(metrics map[string]FieldMetric) {
+						handledMetrics = metrics
+					}),
+					WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+						sentReports = append(sentReports, report)
+						return nil
+					}),
+				)
+				srv.Use(tracer)
+
+				res := map[string]any{}
+				client.New(srv).MustPost("{ todos { id } }", &res)
+				require.NoError(t, tracer.Flush(context.Background()))
+				require.Len(t, sentReports, 1)
+				require.Equal(t, uint64(1), handledMetrics["Query.todos"].Calls)
+				if !inReport {
+					require.Nil(t, sentReports[0].Extensions)
+					return
+				}
+				require.Equal(t, handledMetrics, sentReports[0].Extensions.FieldMetrics)
+
+				data, err := json.Marshal(sentReports[0])
+				require.NoError(t, err)
+				require.Contains(t, string(data), `"extensions":{"fieldMetrics":{"Query.todos":{"calls":1,`)
+			})
 		}
+	})
 
-		snaps.MatchJSON(t, report)
-	}))
-	defer tserver.Close()
+	t.Run("disabled", func(t *testing.T) {
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
 
-	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
-	srv.AddTransport(transport.POST{})
+		var handled bool
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithSendReportTimeout(0),
+			WithFieldMetricsHandler(func(metrics map[string]FieldMetric) {
+				handled = true
+			}),
+			WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+				return nil
+			}),
+		)
+		srv.Use(tracer)
 
-	srv.Use(NewTracer(
-		target.String(),
-		token,
-		WithEndpoint(tserver.URL),
-		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
-			return "id"
-		}),
-		WithSendReportTimeout(0),
-	))
+		res := map[string]any{}
+		client.New(srv).MustPost("{ todos { id } }", &res)
+		require.Nil(t, tracer.FieldMetrics())
+		require.False(t, handled)
+	})
 
-	res := map[string]any{}
-	client.New(srv).MustPost("{ todos { id } }", &res)
-}
+	t.Run("concurrent windows", func(t *testing.T) {
+		tracer := NewTracer(uu.IDv4().String(), "<token>", WithFieldMetrics(true))
 
-//
+		ctx := graphql.WithResponseContext(context.Background(), graphql.DefaultErrorPresenter, graphql.DefaultRecover)
+		ctx = graphql.WithFieldContext(ctx, &graphql.FieldContext{
+			Object: "Query",
+			Field:  graphql.CollectedField{Field: &ast.Field{Name: "todos"}},
+		})
 
-type testLogger struct {
-	logs []string
-}
+		const calls = 10_000
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range calls / 10 {
+					_, _ = tracer.InterceptField(ctx, func(ctx context.Context) (any, error) { return nil, nil })
+				}
+			}()
+		}
 
-func newTestLogger() *testLogger {
-	return &testLogger{}
+		// every record ends up in exactly one window
+		var recorded uint64
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for finished := false; !finished; {
+			select {
+			case <-done:
+				finished = true
+			default:
+			}
+			recorded += tracer.takeFieldMetrics()["Query.todos"].Calls
+		}
+		require.Equal(t, uint64(calls), recorded)
+	})
+
+	t.Run("percentiles", func(t *testing.T) {
+		metrics := &fieldMetrics{}
+		for range 98 {
+			metrics.record("Query.todos", 1500*time.Nanosecond, false)
+		}
+		metrics.record("Query.todos", 3*time.Millisecond, true)
+		metrics.record("Query.todos", time.Hour, false)
+		require.Equal(t, map[string]FieldMetric{
+			"Query.todos": {
+				Calls:  100,
+				Errors: 1,
+				P50:    int64(2 * time.Microsecond),
+				P95:    int64(2 * time.Microsecond),
+				P99:    int64(4096 * time.Microsecond),
+			},
+		}, metrics.snapshot())
+	})
 }
 
-func (l *testLogger) Printf(format string, v ...any) {
-	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+func TestInvalidOperations(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		operationName string
+		operation     string
+	}{
+		{
+			name:      "unparseable",
+			query:     "{ todos { id }",
+			operation: invalidOperationPlaceholder,
+		},
+		{
+			name:      "invalid",
+			query:     "{ todos { nope } }",
+			operation: "query {\n\ttodos {\n\t\tnope\n\t}\n}\n",
+		},
+		{
+			name:          "unknown operation name",
+			query:         "query Todos { todos { id } }",
+			operationName: "Users",
+			operation:     "query Todos { todos { id } }",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+			srv.AddTransport(transport.POST{})
+
+			testLogger := newTestLogger()
+			var sentReport *Report
+			srv.Use(NewTracer(
+				uu.IDv4().String(),
+				"<token>",
+				WithSendReportTimeout(0),
+				WithReportInvalidOperations(true),
+				WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+					sentReport = report
+					return nil
+				}),
+				WithLogger(testLogger),
+			))
+
+			res := map[string]any{}
+			err := client.New(srv).Post(test.query, &res,
+				client.Operation(test.operationName),
+				client.AddHeader("x-graphql-client-name", "web"),
+				client.AddHeader("x-graphql-client-version", "1.2.3"),
+			)
+			require.Error(t, err)
+
+			require.Len(t, sentReport.OperationInfos, 1)
+			info := sentReport.OperationInfos[0]
+			require.False(t, info.Execution.Ok)
+			require.Equal(t, 1, info.Execution.ErrorsTotal)
+			require.Equal(t, Client{Name: "web", Version: "1.2.3"}, info.Metadata.Client)
+			require.Equal(t, test.operation, sentReport.Operations[info.ID].Operation)
+			require.Empty(t, sentReport.Operations[info.ID].Fields)
+
+			require.Len(t, testLogger.logs, 1)
+			require.Contains(t, testLogger.logs[0], "invalid operation")
+			require.Contains(t, testLogger.logs[0], "web@1.2.3")
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		var sentReport *Report
+		srv.Use(NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithSendReportTimeout(0),
+			WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+				sentReport = report
+				return nil
+			}),
+		))
+
+		res := map[string]any{}
+		require.Error(t, client.New(srv).Post("{ todos { nope } }", &res))
+		require.Nil(t, sentReport)
+	})
 }
 
-func TestSendReportError(t *testing.T) {
+func TestReportingExecutedOperation(t *testing.T) {
 	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
 	srv.AddTransport(transport.POST{})
 
-	testLogger := newTestLogger()
-
+	var sentReport *Report
 	srv.Use(NewTracer(
 		uu.IDv4().String(),
 		"<token>",
@@ -327,51 +648,2266 @@ func TestSendReportError(t *testing.T) {
 		}),
 		WithSendReportTimeout(0),
 		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
-			return fmt.Errorf("test fail send report")
+			for _, info := range report.OperationInfos {
+				info.Timestamp = -1
+				info.Execution.Duration = -1
+			}
+			sentReport = report
+			return nil
 		}),
-		WithLogger(testLogger),
 	))
 
 	res := map[string]any{}
-	client.New(srv).MustPost("{ todos { id } }", &res)
+	client.New(srv).MustPost(`
+		query Todos {
+			todos {
+				...TodoFragment
+			}
+		}
+		query TodosWithUsers {
+			todos {
+				# the todo
+				...TodoWithUserFragment
+			}
+		}
+		fragment TodoFragment on Todo {
+			id
+		}
+		fragment TodoWithUserFragment on Todo {
+			...TodoFragment
+			user {
+				...UserFragment
+			}
+		}
+		fragment UserFragment on User {
+			name
+		}
+	`, &res, client.Operation("TodosWithUsers"))
 
-	snaps.MatchSnapshot(t, testLogger.logs)
+	snaps.MatchJSON(t, sentReport)
 }
 
-func TestSendReportServerError(t *testing.T) {
-	var attempt = 0
-	tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		if attempt == 0 {
-			// with body
-			res.WriteHeader(http.StatusBadRequest)
-			res.Write([]byte("test server error"))
-			attempt++
-		} else {
-			// without body
-			res.WriteHeader(http.StatusInternalServerError)
-		}
-	}))
-	defer tserver.Close()
+func TestNormalizeOperations(t *testing.T) {
+	var tests = []struct {
+		name          string
+		operationName string
+		queries       []string
+	}{
+		{
+			name: "formatting and aliases",
+			queries: []string{
+				"{ todos { id text } }",
+				"{todos{text id}}",
+				"# comment\n{ todos { text, id } }",
+				"{ items: todos { ids: id text } }",
+			},
+		},
+		{
+			name: "literals",
+			queries: []string{
+				`mutation CreateTodo {
+				createTodo(input: { text: "Check Mail", userId: "u0" }) {
+					id
+				}
+			}`,
+				`mutation CreateTodo {
+				createTodo(input: { userId: "u1", text: """Buy Milk""" }) {
+					id
+				}
+			}`,
+			},
+		},
+		{
+			name:          "unused definitions and order",
+			operationName: "Todos",
+			queries: []string{
+				`query Todos($searchText: String = "test", $userStatus: TodosConditionUserStatus) {
+				todos(sortBy: NAME_DESC, condition: { searchText: $searchText, userStatus: $userStatus }) {
+					...TodoFragment
+					... on Todo { done }
+				}
+			}
+			fragment TodoFragment on Todo {
+				id
+				user { ...UserFragment }
+			}
+			fragment UserFragment on User {
+				name
+			}
+			fragment UnusedFragment on Todo {
+				text
+			}
+			query Other {
+				todos { id }
+			}`,
+				`query Todos($userStatus: TodosConditionUserStatus, $searchText: String = "other") {
+				todos(condition: { userStatus: $userStatus, searchText: $searchText }, sortBy: NAME_DESC) {
+					... on Todo { done }
+					...TodoFragment
+				}
+			}
+			fragment UserFragment on User {
+				name
+			}
+			fragment TodoFragment on Todo {
+				user { ...UserFragment }
+				id
+			}`,
+			},
+		},
+	}
 
-	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
-	srv.AddTransport(transport.POST{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var normalized []string
+			for _, query := range test.queries {
+				doc, err := operationDocument(query, test.operationName)
+				require.NoError(t, err)
+				normalizeDocument(doc)
+				normalized = append(normalized, printDocument(doc))
+			}
+			for _, document := range normalized[1:] {
+				require.Equal(t, normalized[0], document)
+			}
+			snaps.MatchSnapshot(t, normalized[0])
+		})
+	}
 
-	testLogger := newTestLogger()
+	t.Run("reporting", func(t *testing.T) {
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
 
-	srv.Use(NewTracer(
-		uu.IDv4().String(),
-		"<token>",
-		WithEndpoint(tserver.URL),
-		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
-			return fmt.Sprintf("a%d", attempt)
-		}),
-		WithSendReportTimeout(0),
-		WithLogger(testLogger),
-	))
+		var sentReport *Report
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithSendReportTimeout(time.Minute),
+			WithNormalizeOperations(true),
+			WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+				sentReport = report
+				return nil
+			}),
+		)
+		srv.Use(tracer)
 
-	res := map[string]any{}
-	client.New(srv).MustPost("query a1 { todos { id } }", &res)
-	client.New(srv).MustPost("query a2 { todos { id } }", &res)
+		res := map[string]any{}
+		client.New(srv).MustPost(`{ todos(condition: { searchText: "first" }) { id text } }`, &res)
+		client.New(srv).MustPost(`{ todos(condition: { searchText: "second" }) { text id } }`, &res)
 
-	snaps.MatchSnapshot(t, testLogger.logs)
+		require.NoError(t, tracer.Flush(context.Background()))
+		require.EqualValues(t, 2, sentReport.Size)
+		require.Len(t, sentReport.Operations, 1)
+		for _, operation := range sentReport.Operations {
+			require.NotContains(t, operation.Operation, "first")
+			require.NotContains(t, operation.Operation, "second")
+		}
+	})
+}
+
+func TestPrivacyPolicy(t *testing.T) {
+	query := `# created by jane@example.com
+	mutation CreateTodo($userId: ID! = "u0") {
+		createTodo(input: { text: "Check Mail", userId: $userId }) {
+			id
+			text
+		}
+	}`
+
+	tests := []struct {
+		name   string
+		policy PrivacyPolicy
+	}{
+		{
+			name:   "hide literals",
+			policy: PrivacyPolicy{HideLiterals: true},
+		},
+		{
+			name:   "drop comments",
+			policy: PrivacyPolicy{DropComments: true},
+		},
+		{
+			name:   "redact arguments",
+			policy: PrivacyPolicy{RedactArguments: []string{"text", "userId"}},
+		},
+		{
+			name:   "hash document",
+			policy: PrivacyPolicy{HashDocument: true},
+		},
+		{
+			name: "all",
+			policy: PrivacyPolicy{
+				HideLiterals:    true,
+				DropComments:    true,
+				RedactArguments: []string{"text"},
+				HashDocument:    true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+			srv.AddTransport(transport.POST{})
+
+			var sentReport *Report
+			srv.Use(NewTracer(
+				uu.IDv4().String(),
+				"<token>",
+				WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+					// leaks the document if the privacy policy doesn't apply
+					return operation
+				}),
+				WithSendReportTimeout(0),
+				WithPrivacyPolicy(test.policy),
+				WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+					sentReport = report
+					return nil
+				}),
+			))
+
+			res := map[string]any{}
+			client.New(srv).MustPost(query, &res)
+
+			b, err := json.Marshal(sentReport)
+			require.NoError(t, err)
+			if test.policy.HideLiterals || slices.Contains(test.policy.RedactArguments, "text") || test.policy.HashDocument {
+				require.NotContains(t, string(b), "Check Mail")
+			} else {
+				require.Contains(t, string(b), "Check Mail")
+			}
+			if test.policy.DropComments || test.policy.HashDocument {
+				require.NotContains(t, string(b), "jane@example.com")
+			} else {
+				require.Contains(t, string(b), "jane@example.com")
+			}
+
+			for _, operation := range sentReport.Operations {
+				snaps.MatchSnapshot(t, operation.Operation)
+			}
+		})
+	}
+}
+
+func TestSendingQueuedReports(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var sentReport *Report
+	srv.Use(NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return operation
+		}),
+		WithSendReportTimeout(1*time.Second),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			for _, info := range report.OperationInfos {
+				info.Timestamp = -1
+				info.Execution.Duration = -1
+			}
+			sentReport = report
+			wg.Done() // we also test the amount of SendReport calles here because calling wg.Done too many times will panic
+			return nil
+		}),
+	))
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } } #1", &res)
+	client.New(srv).MustPost("{ todos { id } } #2", &res)
+	client.New(srv).MustPost("{ todos { id } } #3", &res)
+	client.New(srv).MustPost("{ todos { id } } #4", &res)
+
+	wg.Wait()
+
+	snaps.MatchJSON(t, sentReport)
+}
+
+func TestDeduplicatingOperations(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	var sentReport *Report
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithSendReportTimeout(time.Minute),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			sentReport = report
+			return nil
+		}),
+	)
+	srv.Use(tracer)
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } }", &res)
+	client.New(srv).MustPost("{ todos { id } }", &res)
+	client.New(srv).MustPost("{todos{id}} # formatted differently", &res)
+	client.New(srv).MustPost("query Todos { todos { id } }", &res)
+
+	require.NoError(t, tracer.Flush(context.Background()))
+
+	require.EqualValues(t, 4, sentReport.Size)
+	require.Len(t, sentReport.OperationInfos, 4)
+	require.Len(t, sentReport.Operations, 2)
+
+	id := defaultGenerateID("{ todos { id } }", "")
+	require.Contains(t, sentReport.Operations, id)
+	require.Equal(t, "query {\n\ttodos {\n\t\tid\n\t}\n}\n", sentReport.Operations[id].Operation)
+	for _, info := range sentReport.OperationInfos[:3] {
+		require.Equal(t, id, info.ID)
+	}
+	require.Equal(t, defaultGenerateID("query Todos { todos { id } }", ""), sentReport.OperationInfos[3].ID)
+}
+
+func TestDefaultGenerateID(t *testing.T) {
+	id := defaultGenerateID("{ todos { id } }", "")
+	require.Equal(t, id, defaultGenerateID("{todos{id}}", ""))
+	require.Equal(t, id, defaultGenerateID("# comment\n{\n  todos {\n    id\n  }\n}", ""))
+	require.NotEqual(t, id, defaultGenerateID("{ todos { id } }", "Todos"))
+	require.NotEqual(t, id, defaultGenerateID("{ todos { text } }", ""))
+	require.NotEqual(t, defaultGenerateID(`{ todos(condition: { searchText: "a b" }) { id } }`, ""),
+		defaultGenerateID(`{ todos(condition: { searchText: "a  b" }) { id } }`, ""))
+}
+
+func TestSchemaCoordinates(t *testing.T) {
+	schema := graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}).Schema()
+	for _, c := range []struct {
+		name      string
+		query     string
+		variables map[string]any
+		fields    []string
+	}{
+		{
+			"root and output types",
+			"{ todos { id user { name } } }",
+			nil,
+			[]string{"Query", "Query.todos", "Todo", "Todo.id", "ID", "Todo.user", "User", "User.name", "String"},
+		},
+		{
+			"mutation with input object",
+			`mutation { createTodo(input: { text: "a", userId: "u0" }) { id } }`,
+			nil,
+			[]string{
+				"Mutation", "Mutation.createTodo", "Mutation.createTodo.input", "Mutation.createTodo.input!",
+				"NewTodo", "NewTodo.text", "NewTodo.userId", "String", "ID", "Todo", "Todo.id",
+			},
+		},
+		{
+			"null argument",
+			"{ todos(condition: null) { id } }",
+			nil,
+			[]string{"Query", "Query.todos", "Query.todos.condition", "TodosCondition", "Todo", "Todo.id", "ID"},
+		},
+		{
+			"nullable variable",
+			"query ($condition: TodosCondition) { todos(condition: $condition) { id } }",
+			nil,
+			[]string{"Query", "Query.todos", "Query.todos.condition", "TodosCondition", "Todo", "Todo.id", "ID"},
+		},
+		{
+			"non-null variable",
+			"query ($text: String!) { search(text: $text) { __typename } }",
+			nil,
+			[]string{"Query", "Query.search", "Query.search.text", "Query.search.text!", "String", "SearchResult"},
+		},
+		{
+			"list of enums",
+			"{ todos(condition: { statuses: [DONE, DONE] }) { id } }",
+			nil,
+			[]string{
+				"Query", "Query.todos", "Query.todos.condition", "Query.todos.condition!",
+				"TodosCondition", "TodosCondition.statuses", "TodosConditionStatus", "TodosConditionStatus.DONE",
+				"Todo", "Todo.id", "ID",
+			},
+		},
+		{
+			"enum variable",
+			"query ($sortBy: TodosSortBy!) { todos(sortBy: $sortBy) { id } }",
+			map[string]any{"sortBy": "NAME_DESC"},
+			[]string{
+				"Query", "Query.todos", "Query.todos.sortBy", "Query.todos.sortBy!",
+				"TodosSortBy", "TodosSortBy.NAME_DESC", "Todo", "Todo.id", "ID",
+			},
+		},
+		{
+			"input object variable",
+			"query ($condition: TodosCondition) { todos(condition: $condition) { id } }",
+			map[string]any{"condition": map[string]any{
+				"searchText": "a",
+				"statuses":   []any{"DONE"},
+				"user":       map[string]any{"name": nil},
+			}},
+			[]string{
+				"Query", "Query.todos", "Query.todos.condition", "TodosCondition",
+				"TodosCondition.searchText", "String", "TodosCondition.statuses", "TodosConditionStatus",
+				"TodosConditionStatus.DONE", "TodosCondition.user", "TodosConditionUser", "TodosConditionUser.name",
+				"Todo", "Todo.id", "ID",
+			},
+		},
+		{
+			"variable in input object",
+			"query ($status: TodosConditionUserStatus) { todos(condition: { userStatus: $status }) { id } }",
+			map[string]any{"status": "UNAVAILABLE"},
+			[]string{
+				"Query", "Query.todos", "Query.todos.condition", "Query.todos.condition!", "TodosCondition",
+				"TodosCondition.userStatus", "TodosConditionUserStatus", "TodosConditionUserStatus.UNAVAILABLE",
+				"Todo", "Todo.id", "ID",
+			},
+		},
+		{
+			"missing variable",
+			"query ($condition: TodosCondition) { todos(condition: $condition) { id } }",
+			map[string]any{},
+			[]string{"Query", "Query.todos", "Query.todos.condition", "TodosCondition", "Todo", "Todo.id", "ID"},
+		},
+		{
+			"null in input object",
+			"{ todos(condition: { user: null, statuses: [] }) { id } }",
+			nil,
+			[]string{
+				"Query", "Query.todos", "Query.todos.condition", "Query.todos.condition!", "TodosCondition",
+				"TodosCondition.user", "TodosConditionUser", "TodosCondition.statuses", "TodosConditionStatus",
+				"Todo", "Todo.id", "ID",
+			},
+		},
+		{
+			"skipped field",
+			"{ todos { id text @skip(if: true) } }",
+			nil,
+			[]string{"Query", "Query.todos", "Todo", "Todo.id", "ID", "@skip", "@skip(if:)", "Boolean"},
+		},
+		{
+			"included fragments",
+			`query ($withUser: Boolean!) {
+				todos {
+					... on Todo @include(if: $withUser) { user { id } }
+					...TodoFragment @include(if: false)
+				}
+			}
+			fragment TodoFragment on Todo { text }`,
+			map[string]any{"withUser": true},
+			[]string{
+				"Query", "Query.todos", "Todo", "@include", "@include(if:)", "Boolean",
+				"Todo.user", "User", "User.id", "ID",
+			},
+		},
+		{
+			"not included field",
+			"query ($withText: Boolean!) { todos { id text @include(if: $withText) } }",
+			map[string]any{"withText": false},
+			[]string{"Query", "Query.todos", "Todo", "Todo.id", "ID", "@include", "@include(if:)", "Boolean"},
+		},
+		{
+			"union",
+			`{ search(text: "a") { ... on User { todos { done } } } }`,
+			nil,
+			[]string{
+				"Query", "Query.search", "Query.search.text", "Query.search.text!", "String", "SearchResult",
+				"User", "User.todos", "Todo", "Todo.done", "Boolean",
+			},
+		},
+		{
+			"interface",
+			`{ node(id: "t0") { id ... on Todo { text } } }`,
+			nil,
+			[]string{
+				"Query", "Query.node", "Query.node.id", "Query.node.id!", "ID", "Node", "Node.id",
+				"Todo", "Todo.id", "User", "User.id", "Todo.text", "String",
+			},
+		},
+		{
+			"fragments",
+			"query { todos { ...TodoFragment } } fragment TodoFragment on Todo { id }",
+			nil,
+			[]string{"Query", "Query.todos", "Todo", "Todo.id", "ID"},
+		},
+		{
+			"subscription",
+			"subscription { todos { id } }",
+			nil,
+			[]string{"Subscription", "Subscription.todos", "Todo", "Todo.id", "ID"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			doc, err := gqlparser.LoadQuery(schema, c.query)
+			require.Empty(t, err)
+			fields := mergeFields(
+				createFieldsForOperation(schema, doc.Operations[0], c.variables, ConditionalFieldsEvaluated),
+				createFieldsForVariables(schema, doc.Operations[0], c.variables),
+			)
+			require.ElementsMatch(t, c.fields, fields)
+		})
+	}
+}
+
+func FuzzCreateFields(f *testing.F) {
+	schema := graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}).Schema()
+	for _, seed := range []struct{ query, variables string }{
+		{"{ todos { id } }", ""},
+		{`mutation { createTodo(input: { text: "a", userId: "u0" }) { id } }`, ""},
+		{"{ todos(condition: null, sortBy: null) { id } }", ""},
+		{"{ todos(condition: { statuses: [DONE, null], user: null }) { id } }", ""},
+		{"query ($c: TodosCondition) { todos(condition: $c) { id } }", `{"c":{"statuses":["DONE","X"],"user":{"name":null}}}`},
+		{"query ($c: TodosCondition = { searchText: null }) { todos(condition: $c) { id } }", `{"c":null}`},
+		{"query ($s: Boolean!) { todos { id @skip(if: $s) text @include(if: true) } }", `{"s":"true"}`},
+		{"query ($s: [TodosConditionStatus]) { todos(condition: { statuses: $s }) { ... on Todo @skip(if: false) { id } } }", `{"s":[null]}`},
+		{"{ node(id: 1) { id ... on User { name } ...F } } fragment F on Node { ...F id }", ""},
+		{"{ search(text: $undefined) { ...on Todo { text } } } fragment F on Unknown { unknown }", ""},
+		{"subscription @unknown { todos { id } }", ""},
+	} {
+		f.Add(seed.query, seed.variables)
+	}
+	f.Fuzz(func(t *testing.T, query, variablesJSON string) {
+		var variables map[string]any
+		_ = json.Unmarshal([]byte(variablesJSON), &variables)
+
+		// operations that were not validated miss the definitions
+		doc, err := parser.ParseQuery(&ast.Source{Input: query})
+		if err != nil {
+			return
+		}
+		for _, operation := range doc.Operations {
+			createFieldsForOperation(schema, operation, variables, ConditionalFieldsEvaluated)
+			createFieldsForVariables(schema, operation, variables)
+		}
+
+		doc, errs := gqlparser.LoadQuery(schema, query)
+		if errs != nil {
+			return
+		}
+		for _, operation := range doc.Operations {
+			createFieldsForOperation(schema, operation, variables, ConditionalFieldsEvaluated)
+			createFieldsForOperation(nil, operation, variables, ConditionalFieldsReported)
+			createFieldsForVariables(schema, operation, variables)
+		}
+	})
+}
+
+func TestFieldsCache(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		size  int
+		stats CacheStats
+	}{
+		{"enabled", 10, CacheStats{Hits: 3, Misses: 2, Size: 2}},
+		{"evicting", 1, CacheStats{Hits: 2, Misses: 3, Size: 1}},
+		{"disabled", 0, CacheStats{}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+			srv.AddTransport(transport.POST{})
+
+			var sentReport *Report
+			tracer := NewTracer(
+				uu.IDv4().String(),
+				"<token>",
+				WithSendReportTimeout(time.Minute),
+				WithFieldsCacheSize(c.size),
+				WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+					sentReport = report
+					return nil
+				}),
+			)
+			srv.Use(tracer)
+
+			res := map[string]any{}
+			client.New(srv).MustPost("{ todos { id } }", &res)
+			client.New(srv).MustPost("{ todos { id } }", &res)
+			client.New(srv).MustPost("{ todos { text } }", &res)
+			client.New(srv).MustPost("{ todos { text } }", &res)
+			client.New(srv).MustPost("{ todos { id } }", &res)
+
+			require.Equal(t, c.stats, tracer.FieldsCacheStats())
+
+			require.NoError(t, tracer.Flush(context.Background()))
+			require.Equal(t, []string{"Query", "Query.todos", "Todo", "Todo.id", "ID"}, sentReport.Operations[defaultGenerateID("{ todos { id } }", "")].Fields)
+			require.Equal(t, []string{"Query", "Query.todos", "Todo", "Todo.text", "String"}, sentReport.Operations[defaultGenerateID("{ todos { text } }", "")].Fields)
+			if tracer.fieldsCache != nil {
+				// the IDs are cached too
+				for _, operation := range tracer.fieldsCache.cache.Values() {
+					require.Contains(t, sentReport.Operations, operation.id)
+				}
+			}
+		})
+	}
+}
+
+func TestVariableCoordinates(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	var sentReport *Report
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithSendReportTimeout(time.Minute),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			sentReport = report
+			return nil
+		}),
+	)
+	srv.Use(tracer)
+
+	query := "query Todos($condition: TodosCondition) { todos(condition: $condition) { id } }"
+	res := map[string]any{}
+	client.New(srv).MustPost(query, &res, client.Var("condition", map[string]any{"searchText": "a"}))
+	client.New(srv).MustPost(query, &res, client.Var("condition", map[string]any{"userStatus": "AVAILABLE"}))
+	client.New(srv).MustPost(query, &res, client.Var("condition", map[string]any{"searchText": "b"}))
+	client.New(srv).MustPost(query, &res)
+	require.Equal(t, CacheStats{Hits: 3, Misses: 1, Size: 1}, tracer.FieldsCacheStats())
+
+	require.NoError(t, tracer.Flush(context.Background()))
+	require.Len(t, sentReport.Operations, 1)
+	require.Equal(t, []string{
+		"Query",
+		"Query.todos",
+		"Query.todos.condition",
+		"TodosCondition",
+		"Todo",
+		"Todo.id",
+		"ID",
+		"TodosCondition.searchText",
+		"String",
+		"TodosCondition.userStatus",
+		"TodosConditionUserStatus",
+		"TodosConditionUserStatus.AVAILABLE",
+	}, sentReport.Operations[defaultGenerateID(query, "")].Fields)
+}
+
+func TestQueueingRepeatedOperations(t *testing.T) {
+	tracer := NewTracer(uu.IDv4().String(), "<token>", WithSendReportTimeout(time.Minute))
+
+	cached := []string{"Query", "Query.todos", "Todo", "Todo.id", "ID"}
+	queue := func(fields []string) {
+		require.NoError(t, tracer.queueOperation(&OperationWithInfo{
+			Operation:     Operation{Operation: "{ todos { id } }", Fields: fields},
+			OperationInfo: OperationInfo{ID: "todos"},
+		}))
+	}
+
+	queue(cached)
+	queue(cached)
+	// the cached fields are not merged
+	require.Empty(t, tracer.queuedFields)
+
+	queue(append(slices.Clone(cached), "Todo.text", "String"))
+	queue(append(slices.Clone(cached), "String", "Todo.done", "Boolean"))
+	queue(cached)
+	require.Equal(t, []string{"Query", "Query.todos", "Todo", "Todo.id", "ID", "Todo.text", "String", "Todo.done", "Boolean"},
+		tracer.queuedReport.Operations["todos"].Fields)
+	require.Equal(t, 5*operationInfoBytes+operationBytes(tracer.queuedReport.Operations["todos"]), tracer.queuedBytes)
+}
+
+func TestConditionalFields(t *testing.T) {
+	query := "query Todos($withText: Boolean!) { todos { id text @include(if: $withText) } }"
+	for _, c := range []struct {
+		name   string
+		policy ConditionalFields
+		fields [][]string
+	}{
+		{
+			"evaluated",
+			ConditionalFieldsEvaluated,
+			[][]string{
+				{"Query", "Query.todos", "Todo", "Todo.id", "ID", "@include", "@include(if:)", "Boolean"},
+				{"Query", "Query.todos", "Todo", "Todo.id", "ID", "@include", "@include(if:)", "Boolean", "Todo.text", "String"},
+			},
+		},
+		{
+			"reported",
+			ConditionalFieldsReported,
+			[][]string{
+				{"Query", "Query.todos", "Todo", "Todo.id", "ID", "@include", "@include(if:)", "Boolean", "Todo.text", "String"},
+				{"Query", "Query.todos", "Todo", "Todo.id", "ID", "@include", "@include(if:)", "Boolean", "Todo.text", "String"},
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+			srv.AddTransport(transport.POST{})
+
+			var sentReport *Report
+			srv.Use(NewTracer(
+				uu.IDv4().String(),
+				"<token>",
+				WithSendReportTimeout(0),
+				WithConditionalFields(c.policy),
+				WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+					sentReport = report
+					return nil
+				}),
+			))
+
+			res := map[string]any{}
+			client.New(srv).MustPost(query, &res, client.Var("withText", false))
+			require.Equal(t, c.fields[0], sentReport.Operations[defaultGenerateID(query, "")].Fields)
+			client.New(srv).MustPost(query, &res, client.Var("withText", true))
+			require.Equal(t, c.fields[1], sentReport.Operations[defaultGenerateID(query, "")].Fields)
+		})
+	}
+}
+
+func TestSendingQueuedReportsPerTracer(t *testing.T) {
+	newServer := func(target string, reports chan<- *Report) *handler.Server {
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+		srv.Use(NewTracer(
+			target,
+			"<token>",
+			WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+				return operation
+			}),
+			WithSendReportTimeout(100*time.Millisecond),
+			WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+				reports <- report
+				return nil
+			}),
+		))
+		return srv
+	}
+
+	publicReports := make(chan *Report, 1)
+	publicSrv := newServer("org/project/public", publicReports)
+	internalReports := make(chan *Report, 1)
+	internalSrv := newServer("org/project/internal", internalReports)
+
+	res := map[string]any{}
+	client.New(publicSrv).MustPost("query Public { todos { id } }", &res)
+	client.New(internalSrv).MustPost("query Internal { todos { id } }", &res)
+
+	for name, reports := range map[string]chan *Report{
+		"query Public { todos { id } }":   publicReports,
+		"query Internal { todos { id } }": internalReports,
+	} {
+		select {
+		case report := <-reports:
+			require.EqualValues(t, 1, report.Size)
+			require.Contains(t, report.Operations, name)
+		case <-time.After(time.Second):
+			t.Fatalf("report with %q was not sent", name)
+		}
+	}
+}
+
+func TestSendingReportsOnMaxBatchSize(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	reports := make(chan *Report, 1)
+	srv.Use(NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return operation
+		}),
+		WithSendReportTimeout(time.Minute),
+		WithMaxBatchSize(2),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			reports <- report
+			return nil
+		}),
+	))
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } } #1", &res)
+	client.New(srv).MustPost("{ todos { id } } #2", &res)
+
+	select {
+	case report := <-reports:
+		require.EqualValues(t, 2, report.Size)
+	case <-time.After(time.Second):
+		t.Fatal("report was not sent after reaching the max batch size")
+	}
+}
+
+func TestSendingReportsOnMaxBatchSizeWhileFailing(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	var attempts atomic.Int32
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return operation
+		}),
+		WithSendReportTimeout(time.Minute),
+		WithMaxBatchSize(2),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			attempts.Add(1)
+			return errors.New("unavailable")
+		}),
+		WithLogger(newTestLogger()),
+	)
+	srv.Use(tracer)
+
+	res := map[string]any{}
+	for i := range 20 {
+		client.New(srv).MustPost(fmt.Sprintf("{ todos { id } } #%d", i), &res)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// only the first full batch is sent right away, the rest waits for the interval
+	require.EqualValues(t, 1, attempts.Load())
+	tracer.queuedReportMtx.Lock()
+	defer tracer.queuedReportMtx.Unlock()
+	require.EqualValues(t, 20, tracer.queuedReport.Size)
+}
+
+func TestSplittingReportsOnMaxBatchSize(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	failing := true
+	var sentReports []*Report
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return operation
+		}),
+		WithSendReportTimeout(0),
+		WithMaxBatchSize(2),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			if failing {
+				return errors.New("unavailable")
+			}
+			sentReports = append(sentReports, report)
+			return nil
+		}),
+		WithLogger(newTestLogger()),
+	)
+	srv.Use(tracer)
+
+	// the failed reports pile up in the queue
+	res := map[string]any{}
+	for i := range 5 {
+		client.New(srv).MustPost(fmt.Sprintf("{ todos { id } } #%d", i), &res)
+	}
+
+	failing = false
+	require.NoError(t, tracer.Flush(context.Background()))
+
+	var sizes []uint
+	var operations []string
+	for _, report := range sentReports {
+		sizes = append(sizes, report.Size)
+		require.Len(t, report.OperationInfos, int(report.Size))
+		for _, info := range report.OperationInfos {
+			require.Contains(t, report.Operations, info.ID)
+			operations = append(operations, info.ID)
+		}
+	}
+	require.Equal(t, []uint{2, 2, 1}, sizes)
+	require.Equal(t, []string{
+		"{ todos { id } } #0",
+		"{ todos { id } } #1",
+		"{ todos { id } } #2",
+		"{ todos { id } } #3",
+		"{ todos { id } } #4",
+	}, operations)
+}
+
+func TestNegativeSendReportTimeout(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	var sentReport *Report
+	srv.Use(NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithSendReportTimeout(-time.Second),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			sentReport = report
+			return nil
+		}),
+	))
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } }", &res)
+
+	// sent synchronously
+	require.NotNil(t, sentReport)
+	require.EqualValues(t, 1, sentReport.Size)
+}
+
+func TestQueueingWhileSending(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	sending := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	srv.Use(NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return operation
+		}),
+		WithSendReportTimeout(time.Minute),
+		WithMaxBatchSize(1),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			select {
+			case sending <- struct{}{}:
+			default:
+			}
+			<-unblock
+			return nil
+		}),
+	))
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } } #1", &res)
+	<-sending
+
+	executed := make(chan struct{})
+	go func() {
+		defer close(executed)
+		client.New(srv).MustPost("{ todos { id } } #2", &res)
+	}()
+
+	select {
+	case <-executed:
+	case <-time.After(time.Second):
+		t.Fatal("operation execution waited on the report sending")
+	}
+}
+
+func TestDropPolicy(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		policy     DropPolicy
+		operations []string
+	}{
+		{"newest", DropNewest, []string{"{ todos { id } } #1", "{ todos { id } } #2"}},
+		{"oldest", DropOldest, []string{"{ todos { id } } #3", "{ todos { id } } #4"}},
+		// a random sample
+		{"sample", DropSample, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+			srv.AddTransport(transport.POST{})
+
+			var sentReport *Report
+			testLogger := newTestLogger()
+			tracer := NewTracer(
+				uu.IDv4().String(),
+				"<token>",
+				WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+					return operation
+				}),
+				WithSendReportTimeout(time.Minute),
+				WithMaxQueuedOperations(2),
+				WithDropPolicy(c.policy),
+				WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+					sentReport = report
+					return nil
+				}),
+				WithLogger(testLogger),
+			)
+			srv.Use(tracer)
+
+			res := map[string]any{}
+			client.New(srv).MustPost("{ todos { id } } #1", &res)
+			client.New(srv).MustPost("{ todos { id } } #2", &res)
+			client.New(srv).MustPost("{ todos { id } } #3", &res)
+			client.New(srv).MustPost("{ todos { id } } #4", &res)
+
+			require.NoError(t, tracer.Flush(context.Background()))
+
+			var operations []string
+			for _, info := range sentReport.OperationInfos {
+				operations = append(operations, info.ID)
+			}
+			if c.operations != nil {
+				require.Equal(t, c.operations, operations)
+			}
+			require.Len(t, sentReport.Operations, 2)
+			require.EqualValues(t, 2, sentReport.Size)
+			require.EqualValues(t, 2, tracer.DroppedOperations())
+			require.Equal(t, []string{"dropped 2 operations because the queue is full"}, testLogger.logs)
+		})
+	}
+}
+
+func TestDropSampleUniform(t *testing.T) {
+	const operations, maxQueued, runs = 100, 10, 1000
+
+	kept := make([]int, operations)
+	for range runs {
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithSendReportTimeout(time.Minute),
+			WithMaxQueuedOperations(maxQueued),
+			WithDropPolicy(DropSample),
+		)
+		for i := range operations {
+			require.NoError(t, tracer.queueOperation(&OperationWithInfo{
+				Operation:     Operation{Operation: "{ todos { id } }"},
+				OperationInfo: OperationInfo{ID: "todos", Timestamp: int64(i)},
+			}))
+		}
+		require.EqualValues(t, maxQueued, tracer.queuedReport.Size)
+		require.EqualValues(t, operations-maxQueued, tracer.DroppedOperations())
+		for _, info := range tracer.queuedReport.OperationInfos {
+			kept[info.Timestamp]++
+		}
+	}
+
+	// every operation is kept in about maxQueued/operations of the runs, within 5 standard deviations
+	// because there are as many checks as operations
+	p := float64(maxQueued) / operations
+	expected := runs * p
+	sigma := math.Sqrt(runs * p * (1 - p))
+	for i, n := range kept {
+		require.InDelta(t, expected, n, 5*sigma, "operation %d", i)
+	}
+	// as often in the first half as in the second one
+	first := 0
+	for _, n := range kept[:operations/2] {
+		first += n
+	}
+	require.InDelta(t, runs*maxQueued/2, first, 4*math.Sqrt(runs*maxQueued/4))
+}
+
+func TestMaxQueuedBytes(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	var sentReport *Report
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return operation
+		}),
+		WithSendReportTimeout(time.Minute),
+		WithMaxQueuedBytes(operationInfoBytes+64),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			sentReport = report
+			return nil
+		}),
+		WithLogger(newTestLogger()),
+	)
+	srv.Use(tracer)
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } } #1", &res)
+	client.New(srv).MustPost("{ todos { id } } #2", &res)
+
+	require.NoError(t, tracer.Flush(context.Background()))
+	require.EqualValues(t, 1, sentReport.Size)
+	require.Contains(t, sentReport.Operations, "{ todos { id } } #1")
+	require.EqualValues(t, 1, tracer.DroppedOperations())
+}
+
+func TestMaxQueuedBytesOversizedOperation(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	var sentReport *Report
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return operation
+		}),
+		WithSendReportTimeout(time.Minute),
+		WithMaxQueuedBytes(2000),
+		WithDropPolicy(DropOldest),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			sentReport = report
+			return nil
+		}),
+		WithLogger(newTestLogger()),
+	)
+	srv.Use(tracer)
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } } #1", &res)
+	client.New(srv).MustPost("{ todos { id } } #2", &res)
+	client.New(srv).MustPost("query "+strings.Repeat("x", 3000)+" { todos { id } }", &res)
+
+	require.NoError(t, tracer.Flush(context.Background()))
+	require.EqualValues(t, 2, sentReport.Size)
+	require.Contains(t, sentReport.Operations, "{ todos { id } } #1")
+	require.Contains(t, sentReport.Operations, "{ todos { id } } #2")
+	require.EqualValues(t, 1, tracer.DroppedOperations())
+}
+
+func TestSendingEmptyReport(t *testing.T) {
+	var sent bool
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithSendReportTimeout(time.Minute),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			sent = true
+			return nil
+		}),
+	)
+
+	// like when all queued operations got dropped
+	tracer.queuedReportMtx.Lock()
+	tracer.queuedReport = &Report{Operations: map[string]*Operation{}}
+	tracer.queuedRefs = map[string]uint{}
+	tracer.queuedReportMtx.Unlock()
+
+	require.NoError(t, tracer.Flush(context.Background()))
+	require.False(t, sent)
+}
+
+func TestMaxQueuedBytesWithDeduplication(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		policy DropPolicy
+	}{
+		{"oldest", DropOldest},
+		{"sample", DropSample},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+			srv.AddTransport(transport.POST{})
+
+			tracer := NewTracer(
+				uu.IDv4().String(),
+				"<token>",
+				WithSendReportTimeout(time.Minute),
+				WithMaxQueuedBytes(1200),
+				WithDropPolicy(c.policy),
+				WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+					return nil
+				}),
+				WithLogger(newTestLogger()),
+			)
+			srv.Use(tracer)
+
+			// the deduplicated operation gets dropped to make room for itself
+			query := "query " + strings.Repeat("x", 1000) + " { todos { id } }"
+			res := map[string]any{}
+			for range 3 {
+				client.New(srv).MustPost(query, &res)
+			}
+
+			tracer.queuedReportMtx.Lock()
+			defer tracer.queuedReportMtx.Unlock()
+			require.EqualValues(t, 1, tracer.queuedReport.Size)
+			require.Len(t, tracer.queuedReport.Operations, 1)
+			bytes := int(tracer.queuedReport.Size) * operationInfoBytes
+			for _, operation := range tracer.queuedReport.Operations {
+				bytes += operationBytes(operation)
+			}
+			require.Equal(t, bytes, tracer.queuedBytes)
+			require.EqualValues(t, 2, tracer.DroppedOperations())
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	var sentReports []*Report
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return operation
+		}),
+		WithSendReportTimeout(time.Minute),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			sentReports = append(sentReports, report)
+			return nil
+		}),
+	)
+	srv.Use(tracer)
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } } #1", &res)
+	client.New(srv).MustPost("{ todos { id } } #2", &res)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, tracer.Flush(ctx))
+	require.Len(t, sentReports, 1)
+	require.EqualValues(t, 2, sentReports[0].Size)
+
+	// nothing is queued anymore
+	require.NoError(t, tracer.Flush(ctx))
+	require.Len(t, sentReports, 1)
+}
+
+func TestClose(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	var sentReports []*Report
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return operation
+		}),
+		WithSendReportTimeout(time.Minute),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			sentReports = append(sentReports, report)
+			return nil
+		}),
+	)
+	srv.Use(tracer)
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } } #1", &res)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, tracer.Close(ctx))
+	require.Len(t, sentReports, 1)
+	require.EqualValues(t, 1, sentReports[0].Size)
+
+	// operations after closing are not traced
+	client.New(srv).MustPost("{ todos { id } } #2", &res)
+	require.NoError(t, tracer.Close(ctx))
+	require.Len(t, sentReports, 1)
+}
+
+func TestCloseDeadline(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithSendReportTimeout(time.Minute),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			<-unblock
+			return nil
+		}),
+	)
+	srv.Use(tracer)
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } }", &res)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	require.ErrorIs(t, tracer.Close(ctx), context.DeadlineExceeded)
+}
+
+func TestSendTimeout(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	attempts := 0
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithSendReportTimeout(time.Minute),
+		WithSendTimeout(50*time.Millisecond),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2}),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			attempts++
+			// hanging endpoint
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	)
+	srv.Use(tracer)
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } }", &res)
+
+	require.ErrorIs(t, tracer.Flush(context.Background()), context.DeadlineExceeded)
+	require.Equal(t, 2, attempts)
+}
+
+func TestCloseCancelsSending(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	sending := make(chan struct{}, 1)
+	sendErr := make(chan error, 1)
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithSendReportTimeout(time.Minute),
+		WithSendTimeout(0),
+		WithMaxBatchSize(1),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			select {
+			case sending <- struct{}{}:
+			default:
+			}
+			// hanging endpoint
+			<-ctx.Done()
+			select {
+			case sendErr <- ctx.Err():
+			default:
+			}
+			return ctx.Err()
+		}),
+	)
+	srv.Use(tracer)
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } }", &res)
+	<-sending
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	require.ErrorIs(t, tracer.Close(ctx), context.DeadlineExceeded)
+	require.ErrorIs(t, <-sendErr, context.Canceled)
+}
+
+func TestClientInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []TracerOption
+		headers map[string]string
+		client  Client
+	}{
+		{
+			name:   "tracer",
+			client: Client{Name: CLIENT_NAME, Version: CLIENT_VERSION},
+		},
+		{
+			name: "headers",
+			headers: map[string]string{
+				"x-graphql-client-name":    "web",
+				"x-graphql-client-version": "1.2.3",
+			},
+			client: Client{Name: "web", Version: "1.2.3"},
+		},
+		{
+			name: "headers without version",
+			headers: map[string]string{
+				"x-graphql-client-name": "web",
+			},
+			client: Client{Name: "web"},
+		},
+		{
+			name: "custom headers",
+			opts: []TracerOption{
+				WithClientHeaders("apollographql-client-name", "apollographql-client-version"),
+			},
+			headers: map[string]string{
+				"x-graphql-client-name":        "web",
+				"apollographql-client-name":    "ios",
+				"apollographql-client-version": "4.5.6",
+			},
+			client: Client{Name: "ios", Version: "4.5.6"},
+		},
+		{
+			name: "client info",
+			opts: []TracerOption{
+				WithClientInfo(func(ctx context.Context) *Client {
+					return &Client{Name: "custom", Version: "7.8.9"}
+				}),
+			},
+			headers: map[string]string{
+				"x-graphql-client-name": "web",
+			},
+			client: Client{Name: "custom", Version: "7.8.9"},
+		},
+		{
+			name: "client info fallback",
+			opts: []TracerOption{
+				WithClientInfo(func(ctx context.Context) *Client {
+					return nil
+				}),
+			},
+			headers: map[string]string{
+				"x-graphql-client-name":    "web",
+				"x-graphql-client-version": "1.2.3",
+			},
+			client: Client{Name: "web", Version: "1.2.3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+			srv.AddTransport(transport.POST{})
+
+			var sentReport *Report
+			srv.Use(NewTracer(
+				uu.IDv4().String(),
+				"<token>",
+				append([]TracerOption{
+					WithSendReportTimeout(0),
+					WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+						sentReport = report
+						return nil
+					}),
+				}, test.opts...)...,
+			))
+
+			var opts []client.Option
+			for key, value := range test.headers {
+				opts = append(opts, client.AddHeader(key, value))
+			}
+			res := map[string]any{}
+			client.New(srv).MustPost("{ todos { id } }", &res, opts...)
+
+			require.Len(t, sentReport.OperationInfos, 1)
+			require.Equal(t, test.client, sentReport.OperationInfos[0].Metadata.Client)
+		})
+	}
+}
+
+func TestSampling(t *testing.T) {
+	t.Run("at least once per report", func(t *testing.T) {
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		var sentReport *Report
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithSendReportTimeout(time.Minute),
+			WithSampleRate(0),
+			WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+				sentReport = report
+				return nil
+			}),
+		)
+		srv.Use(tracer)
+
+		res := map[string]any{}
+		for range 10 {
+			client.New(srv).MustPost("{ todos { id } }", &res)
+			client.New(srv).MustPost("{ todos { text } }", &res)
+		}
+
+		require.NoError(t, tracer.Flush(context.Background()))
+		require.EqualValues(t, 2, sentReport.Size)
+		require.Len(t, sentReport.Operations, 2)
+
+		// sampled again in the next report
+		client.New(srv).MustPost("{ todos { id } }", &res)
+		client.New(srv).MustPost("{ todos { id } }", &res)
+
+		require.NoError(t, tracer.Flush(context.Background()))
+		require.EqualValues(t, 1, sentReport.Size)
+		require.Len(t, sentReport.Operations, 1)
+	})
+
+	t.Run("unique generated IDs", func(t *testing.T) {
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		var sentReport *Report
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+				return uu.IDv4().String()
+			}),
+			WithSendReportTimeout(time.Minute),
+			WithSampleRate(0),
+			WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+				sentReport = report
+				return nil
+			}),
+		)
+		srv.Use(tracer)
+
+		res := map[string]any{}
+		for range 10 {
+			client.New(srv).MustPost("{ todos { id } }", &res)
+		}
+
+		require.NoError(t, tracer.Flush(context.Background()))
+		require.EqualValues(t, 1, sentReport.Size)
+	})
+
+	t.Run("synchronous sending", func(t *testing.T) {
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		var reported int
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithSendReportTimeout(0),
+			WithSampleRate(0),
+			WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+				reported += int(report.Size)
+				return nil
+			}),
+		)
+		srv.Use(tracer)
+
+		res := map[string]any{}
+		for range 10 {
+			client.New(srv).MustPost("{ todos { id } }", &res)
+			client.New(srv).MustPost("{ todos { text } }", &res)
+		}
+
+		require.Equal(t, 2, reported)
+	})
+
+	t.Run("sampler", func(t *testing.T) {
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		var sentReport *Report
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithSendReportTimeout(time.Minute),
+			WithSampler(func(ctx context.Context, operationCtx *graphql.OperationContext) float64 {
+				if operationCtx.OperationName == "Important" {
+					return 1
+				}
+				return 0
+			}),
+			WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+				sentReport = report
+				return nil
+			}),
+		)
+		srv.Use(tracer)
+
+		res := map[string]any{}
+		for range 10 {
+			client.New(srv).MustPost("query Important { todos { id } }", &res, client.Operation("Important"))
+			client.New(srv).MustPost("query Unimportant { todos { id } }", &res, client.Operation("Unimportant"))
+		}
+
+		require.NoError(t, tracer.Flush(context.Background()))
+		require.EqualValues(t, 11, sentReport.Size)
+		require.Len(t, sentReport.Operations, 2)
+	})
+}
+
+func TestExclude(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+	srv.Use(extension.Introspection{})
+
+	var sentReport *Report
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithSendReportTimeout(time.Minute),
+		WithExclude(
+			ExcludeOperationNames("HealthCheck"),
+			ExcludeOperationNamesMatching(regexp.MustCompile("^Synthetic")),
+			func(operationCtx *graphql.OperationContext) bool {
+				return operationCtx.Headers.Get("x-monitoring") != ""
+			},
+		),
+		WithExcludeIntrospection(true),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			sentReport = report
+			return nil
+		}),
+	)
+	srv.Use(tracer)
+
+	res := map[string]any{}
+	client.New(srv).MustPost("query HealthCheck { todos { id } }", &res)
+	client.New(srv).MustPost("query SyntheticTodos { todos { id } }", &res)
+	client.New(srv).MustPost("query Monitored { todos { id } }", &res, client.AddHeader("x-monitoring", "1"))
+	client.New(srv).MustPost("{ __schema { queryType { name } } }", &res)
+	client.New(srv).MustPost("query Introspection { ...Introspection } fragment Introspection on Query { __type(name: \"Todo\") { name } __typename }", &res)
+	client.New(srv).MustPost("query Todos { todos { id } }", &res)
+	client.New(srv).MustPost("query TodosWithTypename { __typename todos { id } }", &res)
+
+	require.NoError(t, tracer.Flush(context.Background()))
+	require.EqualValues(t, 2, sentReport.Size)
+	var operations []string
+	for _, operation := range sentReport.Operations {
+		operations = append(operations, operation.Operation)
+	}
+	require.ElementsMatch(t, []string{
+		"query Todos {\n\ttodos {\n\t\tid\n\t}\n}\n",
+		"query TodosWithTypename {\n\t__typename\n\ttodos {\n\t\tid\n\t}\n}\n",
+	}, operations)
+}
+
+func TestSubscriptions(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.Websocket{})
+	srv.AddTransport(transport.POST{})
+
+	var sentReport *Report
+	tracer := NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return operation
+		}),
+		WithSendReportTimeout(time.Minute),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			for _, info := range report.OperationInfos {
+				info.Timestamp = -1
+				info.Execution.Duration = -1
+			}
+			for _, info := range report.SubscriptionOperationInfos {
+				info.Timestamp = -1
+			}
+			sentReport = report
+			return nil
+		}),
+	)
+	srv.Use(tracer)
+
+	sub := client.New(srv).Websocket("subscription { todos { id text } }")
+	defer sub.Close()
+	for range 2 {
+		var res struct {
+			Todos struct {
+				ID   string
+				Text string
+			}
+		}
+		require.NoError(t, sub.Next(&res))
+		require.NotEmpty(t, res.Todos.ID)
+	}
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } }", &res)
+
+	require.NoError(t, tracer.Flush(context.Background()))
+	require.Len(t, sentReport.SubscriptionOperationInfos, 1)
+	require.Len(t, sentReport.OperationInfos, 1)
+	snaps.MatchJSON(t, sentReport)
+}
+
+func TestSendingReportsOverHTTP(t *testing.T) {
+	target := uu.IDv4()
+	token := "sometoken123"
+	tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+
+		require.Equal(t, "/"+target.String(), req.URL.Path)
+
+		require.Equal(t, "POST", req.Method)
+		require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		require.Equal(t, fmt.Sprintf("Bearer %s", token), req.Header.Get("Authorization"))
+		require.Equal(t, "2", req.Header.Get("X-Usage-API-Version"))
+
+		report := &Report{}
+		err := json.NewDecoder(req.Body).Decode(&report)
+		require.NoError(t, err)
+
+		for _, info := range report.OperationInfos {
+			info.Timestamp = -1
+			info.Execution.Duration = -1
+		}
+
+		snaps.MatchJSON(t, report)
+	}))
+	defer tserver.Close()
+
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	srv.Use(NewTracer(
+		target.String(),
+		token,
+		WithEndpoint(tserver.URL),
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return "id"
+		}),
+		WithSendReportTimeout(0),
+	))
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } }", &res)
+}
+
+func TestSendingReportsOverHTTPWithSuccessStatus(t *testing.T) {
+	for _, status := range []int{http.StatusAccepted, http.StatusNoContent} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			var requests int
+			tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				requests++
+				res.WriteHeader(status)
+			}))
+			defer tserver.Close()
+
+			srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+			srv.AddTransport(transport.POST{})
+
+			testLogger := newTestLogger()
+			tracer := NewTracer(
+				uu.IDv4().String(),
+				"<token>",
+				WithEndpoint(tserver.URL),
+				WithSendReportTimeout(0),
+				WithLogger(testLogger),
+			)
+			srv.Use(tracer)
+
+			res := map[string]any{}
+			client.New(srv).MustPost("{ todos { id } }", &res)
+			client.New(srv).MustPost("{ todos { text } }", &res)
+			require.NoError(t, tracer.Flush(context.Background()))
+
+			// sent once each and not requeued
+			require.Equal(t, 2, requests)
+			require.Empty(t, testLogger.logs)
+		})
+	}
+}
+
+func TestSendingCompressedReportsOverHTTP(t *testing.T) {
+	for _, c := range []struct {
+		name            string
+		minSize         int
+		contentEncoding string
+	}{
+		{"compressed", 0, "gzip"},
+		{"below min size", 1 << 20, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var sentReport *Report
+			tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusOK)
+
+				require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+				require.Equal(t, c.contentEncoding, req.Header.Get("Content-Encoding"))
+
+				var body io.Reader = req.Body
+				if c.contentEncoding == "gzip" {
+					gzipReader, err := gzip.NewReader(req.Body)
+					require.NoError(t, err)
+					defer gzipReader.Close()
+					body = gzipReader
+				}
+
+				report := &Report{}
+				err := json.NewDecoder(body).Decode(&report)
+				require.NoError(t, err)
+				sentReport = report
+			}))
+			defer tserver.Close()
+
+			srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+			srv.AddTransport(transport.POST{})
+
+			srv.Use(NewTracer(
+				uu.IDv4().String(),
+				"<token>",
+				WithEndpoint(tserver.URL),
+				WithSendReportTimeout(0),
+				WithCompression(CompressionGzip),
+				WithCompressionMinSize(c.minSize),
+			))
+
+			res := map[string]any{}
+			client.New(srv).MustPost("{ todos { id } }", &res)
+
+			require.NotNil(t, sentReport)
+			require.EqualValues(t, 1, sentReport.Size)
+			require.Equal(t, "query {\n\ttodos {\n\t\tid\n\t}\n}\n", sentReport.Operations[defaultGenerateID("{ todos { id } }", "")].Operation)
+		})
+	}
+}
+
+type testRoundTripper struct {
+	requests int
+}
+
+func (rt *testRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestSendingReportsWithCustomHTTPClient(t *testing.T) {
+	tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "00-trace-span-01", req.Header.Get("Traceparent"))
+		res.WriteHeader(http.StatusOK)
+	}))
+	defer tserver.Close()
+
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	roundTripper := &testRoundTripper{}
+	testLogger := newTestLogger()
+	srv.Use(NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithEndpoint(tserver.URL),
+		WithSendReportTimeout(0),
+		WithHTTPClient(&http.Client{Transport: roundTripper}),
+		WithRequestHook(func(req *http.Request) error {
+			req.Header.Set("Traceparent", "00-trace-span-01")
+			return nil
+		}),
+		WithLogger(testLogger),
+	))
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } }", &res)
+
+	require.Equal(t, 1, roundTripper.requests)
+	require.Empty(t, testLogger.logs)
+}
+
+func TestSendingReportsReusesConnections(t *testing.T) {
+	var connections atomic.Int32
+	tserver := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+		// larger than what the transport drains by itself when closing
+		res.Write([]byte(strings.Repeat(" ", 1<<20)))
+	}))
+	tserver.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	tserver.Start()
+	defer tserver.Close()
+
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	testLogger := newTestLogger()
+	srv.Use(NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithEndpoint(tserver.URL),
+		WithSendReportTimeout(0),
+		WithHTTPClient(&http.Client{Transport: &http.Transport{}}),
+		WithLogger(testLogger),
+	))
+
+	res := map[string]any{}
+	for range 3 {
+		client.New(srv).MustPost("{ todos { id } }", &res)
+	}
+
+	require.EqualValues(t, 1, connections.Load())
+	require.Empty(t, testLogger.logs)
+}
+
+func TestSendingReportsWithNilHTTPClient(t *testing.T) {
+	var requests int
+	tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests++
+		res.WriteHeader(http.StatusOK)
+	}))
+	defer tserver.Close()
+
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	testLogger := newTestLogger()
+	srv.Use(NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithEndpoint(tserver.URL),
+		WithSendReportTimeout(0),
+		WithHTTPClient(nil),
+		WithLogger(testLogger),
+	))
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } }", &res)
+
+	require.Equal(t, 1, requests)
+	require.Empty(t, testLogger.logs)
+}
+
+func TestRequestHookError(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	roundTripper := &testRoundTripper{}
+	testLogger := newTestLogger()
+	srv.Use(NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return "id"
+		}),
+		WithSendReportTimeout(0),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithHTTPClient(&http.Client{Transport: roundTripper}),
+		WithRequestHook(func(req *http.Request) error {
+			return errors.New("no egress token")
+		}),
+		WithLogger(testLogger),
+	))
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } }", &res)
+
+	require.Equal(t, 0, roundTripper.requests)
+	require.Equal(t, []string{`failed to send report for operation "id": no egress token`}, testLogger.logs)
+}
+
+//
+
+type testLogger struct {
+	logs []string
+}
+
+func newTestLogger() *testLogger {
+	return &testLogger{}
+}
+
+func (l *testLogger) Printf(format string, v ...any) {
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+func TestSendReportError(t *testing.T) {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	testLogger := newTestLogger()
+
+	srv.Use(NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return "id"
+		}),
+		WithSendReportTimeout(0),
+		WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+			return fmt.Errorf("test fail send report")
+		}),
+		WithLogger(testLogger),
+	))
+
+	res := map[string]any{}
+	client.New(srv).MustPost("{ todos { id } }", &res)
+
+	snaps.MatchSnapshot(t, testLogger.logs)
+}
+
+func TestSendReportServerError(t *testing.T) {
+	var attempt = 0
+	tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if attempt == 0 {
+			// with body
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte("test server error"))
+			attempt++
+		} else {
+			// without body
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer tserver.Close()
+
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	srv.AddTransport(transport.POST{})
+
+	testLogger := newTestLogger()
+
+	srv.Use(NewTracer(
+		uu.IDv4().String(),
+		"<token>",
+		WithEndpoint(tserver.URL),
+		WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+			return fmt.Sprintf("a%d", attempt)
+		}),
+		WithSendReportTimeout(0),
+		WithLogger(testLogger),
+	))
+
+	res := map[string]any{}
+	client.New(srv).MustPost("query a1 { todos { id } }", &res)
+	client.New(srv).MustPost("query a2 { todos { id } }", &res)
+
+	snaps.MatchSnapshot(t, testLogger.logs)
+}
+
+func TestSendReportRetry(t *testing.T) {
+	retryPolicy := RetryPolicy{
+		MaxAttempts: 3,
+		BaseBackoff: time.Millisecond,
+		MaxBackoff:  10 * time.Millisecond,
+	}
+
+	t.Run("retryable", func(t *testing.T) {
+		var statuses = []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}
+		var attempts int
+		tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.WriteHeader(statuses[attempts])
+			attempts++
+		}))
+		defer tserver.Close()
+
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		testLogger := newTestLogger()
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithEndpoint(tserver.URL),
+			WithSendReportTimeout(time.Minute),
+			WithRetryPolicy(retryPolicy),
+			WithLogger(testLogger),
+		)
+		srv.Use(tracer)
+
+		res := map[string]any{}
+		client.New(srv).MustPost("{ todos { id } }", &res)
+		require.NoError(t, tracer.Flush(context.Background()))
+
+		require.Equal(t, 3, attempts)
+		require.Empty(t, testLogger.logs)
+	})
+
+	t.Run("synchronous", func(t *testing.T) {
+		var attempts int
+		tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			attempts++
+			res.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer tserver.Close()
+
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithEndpoint(tserver.URL),
+			WithSendReportTimeout(0),
+			WithRetryPolicy(RetryPolicy{
+				MaxAttempts: 3,
+				BaseBackoff: time.Second,
+				MaxBackoff:  time.Second,
+			}),
+			WithLogger(newTestLogger()),
+		)
+		srv.Use(tracer)
+
+		// the response doesn't wait for retries
+		start := time.Now()
+		res := map[string]any{}
+		client.New(srv).MustPost("{ todos { id } }", &res)
+		require.Less(t, time.Since(start), time.Second)
+		require.Equal(t, 1, attempts)
+
+		// the failed report is requeued
+		tracer.queuedReportMtx.Lock()
+		defer tracer.queuedReportMtx.Unlock()
+		require.EqualValues(t, 1, tracer.queuedReport.Size)
+	})
+
+	t.Run("permanent", func(t *testing.T) {
+		var sentReports []*Report
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		srv.Use(NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+				return operation
+			}),
+			WithSendReportTimeout(0),
+			WithRetryPolicy(retryPolicy),
+			WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+				sentReports = append(sentReports, report)
+				if len(sentReports) == 1 {
+					return &SendReportError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"}
+				}
+				return nil
+			}),
+			WithLogger(newTestLogger()),
+		))
+
+		res := map[string]any{}
+		client.New(srv).MustPost("{ todos { id } } #1", &res)
+		client.New(srv).MustPost("{ todos { id } } #2", &res)
+
+		// no retries and the failed report is dropped
+		require.Len(t, sentReports, 2)
+		require.EqualValues(t, 1, sentReports[1].Size)
+		require.Contains(t, sentReports[1].Operations, "{ todos { id } } #2")
+	})
+
+	t.Run("requeue", func(t *testing.T) {
+		var sentReports []*Report
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithGenerateID(func(operation string, operationName nullable.TrimmedString) string {
+				return operation
+			}),
+			WithSendReportTimeout(time.Minute),
+			WithRetryPolicy(retryPolicy),
+			WithSendReport(func(ctx context.Context, endpoint, target, token string, report *Report) error {
+				sentReports = append(sentReports, report)
+				if len(sentReports) <= retryPolicy.MaxAttempts {
+					return errors.New("network blip")
+				}
+				return nil
+			}),
+			WithLogger(newTestLogger()),
+		)
+		srv.Use(tracer)
+
+		res := map[string]any{}
+		client.New(srv).MustPost("{ todos { id } } #1", &res)
+		require.Error(t, tracer.Flush(context.Background()))
+		require.Len(t, sentReports, retryPolicy.MaxAttempts)
+
+		client.New(srv).MustPost("{ todos { id } } #2", &res)
+		require.NoError(t, tracer.Flush(context.Background()))
+
+		// the failed report is sent together with the next one
+		require.Len(t, sentReports, retryPolicy.MaxAttempts+1)
+		report := sentReports[retryPolicy.MaxAttempts]
+		require.EqualValues(t, 2, report.Size)
+		require.Equal(t, "{ todos { id } } #1", report.OperationInfos[0].ID)
+		require.Equal(t, "{ todos { id } } #2", report.OperationInfos[1].ID)
+	})
+
+	t.Run("retry-after", func(t *testing.T) {
+		var attemptTimes []time.Time
+		tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			attemptTimes = append(attemptTimes, time.Now())
+			if len(attemptTimes) == 1 {
+				res.Header().Set("Retry-After", "1")
+				res.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			res.WriteHeader(http.StatusOK)
+		}))
+		defer tserver.Close()
+
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithEndpoint(tserver.URL),
+			WithSendReportTimeout(time.Minute),
+			WithRetryPolicy(RetryPolicy{
+				MaxAttempts: 3,
+				BaseBackoff: time.Millisecond,
+				MaxBackoff:  2 * time.Second,
+			}),
+		)
+		srv.Use(tracer)
+
+		res := map[string]any{}
+		client.New(srv).MustPost("{ todos { id } }", &res)
+		require.NoError(t, tracer.Flush(context.Background()))
+
+		require.Len(t, attemptTimes, 2)
+		require.GreaterOrEqual(t, attemptTimes[1].Sub(attemptTimes[0]), time.Second)
+	})
+
+	t.Run("retry-after over max backoff", func(t *testing.T) {
+		var attempts int
+		tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			attempts++
+			if attempts == 1 {
+				res.Header().Set("Retry-After", "1")
+				res.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			res.WriteHeader(http.StatusOK)
+		}))
+		defer tserver.Close()
+
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		testLogger := newTestLogger()
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithEndpoint(tserver.URL),
+			WithSendReportTimeout(0),
+			WithRetryPolicy(retryPolicy),
+			WithLogger(testLogger),
+		)
+		srv.Use(tracer)
+
+		start := time.Now()
+		res := map[string]any{}
+		client.New(srv).MustPost("{ todos { id } }", &res)
+		client.New(srv).MustPost("{ todos { text } }", &res)
+
+		// not retried in place and not sent again until the requested time passes
+		require.Less(t, time.Since(start), time.Second)
+		require.Equal(t, 1, attempts)
+		require.Len(t, testLogger.logs, 1)
+
+		// flushing gives up when the deadline comes before the requested time
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, tracer.Flush(ctx), context.DeadlineExceeded)
+		require.Equal(t, 1, attempts)
+
+		// and waits for the requested time otherwise
+		require.NoError(t, tracer.Flush(context.Background()))
+		require.GreaterOrEqual(t, time.Since(start), time.Second)
+		require.Equal(t, 2, attempts)
+		tracer.queuedReportMtx.Lock()
+		defer tracer.queuedReportMtx.Unlock()
+		require.Nil(t, tracer.queuedReport)
+	})
+
+	t.Run("closing waits for retry-after", func(t *testing.T) {
+		var attempts int
+		tserver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			attempts++
+			if attempts == 1 {
+				res.Header().Set("Retry-After", "1")
+				res.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			res.WriteHeader(http.StatusOK)
+		}))
+		defer tserver.Close()
+
+		srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		srv.AddTransport(transport.POST{})
+
+		tracer := NewTracer(
+			uu.IDv4().String(),
+			"<token>",
+			WithEndpoint(tserver.URL),
+			WithSendReportTimeout(0),
+			WithRetryPolicy(retryPolicy),
+			WithLogger(newTestLogger()),
+		)
+		srv.Use(tracer)
+
+		start := time.Now()
+		res := map[string]any{}
+		client.New(srv).MustPost("{ todos { id } }", &res)
+		require.Equal(t, 1, attempts)
+
+		// the queued operation is sent once the requested time passes, before the deadline
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, tracer.Close(ctx))
+		require.GreaterOrEqual(t, time.Since(start), time.Second)
+		require.Equal(t, 2, attempts)
+		tracer.queuedReportMtx.Lock()
+		defer tracer.queuedReportMtx.Unlock()
+		require.Nil(t, tracer.queuedReport)
+	})
 }
@@ -2,15 +2,25 @@ package gqlhive
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
 	"time"
 
+	"github.com/99designs/gqlgen/graphql"
 	"github.com/domonda/go-types/nullable"
-	"github.com/domonda/go-types/uu"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/lexer"
 )
 
 const defaultEndpoint = "https://app.graphql-hive.com/usage"
@@ -23,15 +33,38 @@ func WithEndpoint(endpoint string) TracerOption {
 	})
 }
 
+// defaultGenerateID hashes the operation's tokens, ignoring whitespace and comments,
+// together with the operation name. Formatting differences therefore produce the same ID.
 func defaultGenerateID(operation string, operationName nullable.TrimmedString) string {
-	return uu.IDv4().String()
+	hash := sha256.New()
+	lex := lexer.New(&ast.Source{Input: operation})
+	for {
+		token, err := lex.ReadToken()
+		if err != nil {
+			// not a valid document, use it as is
+			hash.Reset()
+			hash.Write([]byte(operation))
+			break
+		}
+		if token.Kind == lexer.EOF {
+			break
+		}
+		if token.Kind == lexer.Comment {
+			continue
+		}
+		fmt.Fprintf(hash, "%d%q", token.Kind, token.Value)
+	}
+	fmt.Fprintf(hash, "%q", operationName)
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
-// GenerateID creates unique operation IDs for the report.
+// GenerateID creates operation IDs for the report.
+// Operations with the same ID are considered the same and stored only once in the report.
 type GenerateID func(operation string, operationName nullable.TrimmedString) string
 
-// WithGenerateID sets the unique operation ID generator for the reports.
-// Defaults to generating v4 UUIDs.
+// WithGenerateID sets the operation ID generator for the reports. Unlike the IDs of the default generator,
+// which are cached together with the fields of the operation, custom generators are called on every execution.
+// Defaults to a SHA-256 hash of the operation document, ignoring whitespace and comments, and the operation name.
 func WithGenerateID(fn GenerateID) TracerOption {
 	return tracerOptionFn(func(tracer *Tracer) {
 		tracer.generateID = fn
@@ -40,48 +73,332 @@ func WithGenerateID(fn GenerateID) TracerOption {
 
 var defaultSendReportTimeout time.Duration = 3 * time.Second
 
-// WithSendReportTimeout sets the report sending debounce timeout.
-// Executed operations will queue up and then be flushed/sent to GraphQL Hive after the timeout expires.
+// WithSendReportTimeout sets the report sending interval.
+// Executed operations will queue up and then be flushed/sent to GraphQL Hive in the background every time the timeout expires.
+// Setting it to 0, or less, sends the report synchronously after each operation. The response then waits
+// for a single attempt, bounded by the send timeout, and failed reports are sent with the next operation.
 func WithSendReportTimeout(timeout time.Duration) TracerOption {
 	return tracerOptionFn(func(tracer *Tracer) {
 		tracer.sendReportTimeout = timeout
 	})
 }
 
-func defaultSendReport(ctx context.Context, endpoint, target, token string, report *Report) error {
+var defaultSendTimeout time.Duration = 10 * time.Second
+
+// WithSendTimeout sets the maximum duration of a single report sending attempt.
+// Sending that takes longer, like when GraphQL Hive hangs, is cancelled and retried following the retry policy.
+// Defaults to 10s, setting it to 0 removes the limit.
+func WithSendTimeout(timeout time.Duration) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.sendTimeout = timeout
+	})
+}
+
+var defaultMaxBatchSize uint = 1000
+
+// WithMaxBatchSize sets the maximum number of operations in a single report.
+// Reaching the size flushes the queued operations without waiting for the send report timeout,
+// more queued operations, like after failing to send, are sent in multiple reports.
+// Setting it to 0 disables flushing by size.
+func WithMaxBatchSize(size uint) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.maxBatchSize = size
+	})
+}
+
+var defaultMaxQueuedOperations uint = 10_000
+
+// WithMaxQueuedOperations sets the maximum number of operations waiting in the queue to be sent.
+// The queue fills up when reports cannot be sent, like when GraphQL Hive is unreachable,
+// after which operations get dropped following the drop policy.
+// Defaults to 10000, setting it to 0 removes the limit.
+func WithMaxQueuedOperations(operations uint) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.maxQueuedOperations = operations
+	})
+}
+
+// WithMaxQueuedBytes sets the approximate maximum size in bytes of the operations waiting in the queue to be sent.
+// After reaching the size, operations get dropped following the drop policy.
+// Defaults to 0 which means there is no limit.
+func WithMaxQueuedBytes(bytes uint) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.maxQueuedBytes = bytes
+	})
+}
+
+// DropPolicy decides which operations get dropped when the queue is full.
+type DropPolicy int
+
+const (
+	// DropNewest drops the incoming operations while the queue is full.
+	DropNewest DropPolicy = iota
+	// DropOldest drops the oldest queued operations to make room for the incoming ones.
+	DropOldest
+	// DropSample keeps a uniform random sample of the operations executed since the queue was last sent
+	// by dropping either the incoming operation or a random queued one to make room for it.
+	DropSample
+)
+
+// WithDropPolicy sets which operations get dropped when the queue is full.
+// The number of dropped operations is logged periodically and can be read using [Tracer.DroppedOperations].
+// Defaults to [DropNewest].
+func WithDropPolicy(policy DropPolicy) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.dropPolicy = policy
+	})
+}
+
+var defaultFieldsCacheSize = 1000
+
+// WithFieldsCacheSize sets the maximum number of operations whose fields (schema coordinates) and reported documents are cached.
+// The least recently used operations get evicted when the cache is full. Read the stats using [Tracer.FieldsCacheStats].
+// Defaults to 1000, setting it to 0 disables the cache.
+func WithFieldsCacheSize(size int) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.fieldsCacheSize = size
+	})
+}
+
+// WithFieldMetrics sets whether the calls, errors and latency percentiles of every resolved field are
+// aggregated per schema coordinate. The metrics are collected between sending reports, can be read using
+// [Tracer.FieldMetrics] and are passed to the [FieldMetricsHandler]. They are sent to GraphQL Hive only
+// when enabled using [WithFieldMetricsInReport].
+// Defaults to false.
+func WithFieldMetrics(enabled bool) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.fieldMetricsEnabled = enabled
+	})
+}
+
+// FieldMetricsHandler receives the field metrics, keyed by their schema coordinates, collected
+// since the previous time the reports were sent.
+type FieldMetricsHandler func(metrics map[string]FieldMetric)
+
+// WithFieldMetricsHandler sets the handler receiving the field metrics whenever the reports are sent,
+// like for exporting them to a metrics backend. Has no effect when the field metrics are disabled.
+func WithFieldMetricsHandler(handler FieldMetricsHandler) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.fieldMetricsHandler = handler
+	})
+}
+
+// WithFieldMetricsInReport sets whether the field metrics are attached to the sent reports as the
+// "fieldMetrics" extension. The metrics collected since the previous report go with the first report
+// sent, the ones collected while there is nothing to send are not reported. GraphQL Hive doesn't
+// document the report extensions and rejecting the unknown field would fail the reports permanently,
+// losing the reported operations too. Has no effect when the field metrics are disabled.
+// Defaults to false.
+func WithFieldMetricsInReport(enabled bool) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.fieldMetricsInReport = enabled
+	})
+}
+
+// ConditionalFields decides how fields, fragments and inline fragments with the @skip and @include directives are reported.
+type ConditionalFields int
+
+const (
+	// ConditionalFieldsEvaluated evaluates the directives against the variables of the operation,
+	// reporting only what gets executed.
+	ConditionalFieldsEvaluated ConditionalFields = iota
+	// ConditionalFieldsReported reports everything regardless of the directives.
+	ConditionalFieldsReported
+)
+
+// WithConditionalFields sets how fields with the @skip and @include directives are reported.
+// The directives themselves are reported in both cases.
+// Defaults to [ConditionalFieldsEvaluated].
+func WithConditionalFields(policy ConditionalFields) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.conditionalFields = policy
+	})
+}
+
+// Compression is the encoding used to compress the reports sent by the default report sender.
+// Only gzip is supported, zstd is left out because the standard library has no encoder for it.
+type Compression string
+
+const (
+	// CompressionNone sends the reports uncompressed.
+	CompressionNone Compression = ""
+	// CompressionGzip compresses the reports using gzip.
+	CompressionGzip Compression = "gzip"
+)
+
+// WithCompression sets the compression of the reports sent by the default report sender.
+// Has no effect when using a custom report sender.
+// Defaults to [CompressionNone].
+func WithCompression(compression Compression) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.compression = compression
+	})
+}
+
+var defaultCompressionMinSize = 1024
+
+// WithCompressionMinSize sets the minimum size in bytes of the report payload for it to be compressed.
+// Small payloads don't benefit from compression.
+// Defaults to 1024.
+func WithCompressionMinSize(size int) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.compressionMinSize = size
+	})
+}
+
+func compress(compression Compression, payload []byte) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	switch compression {
+	case CompressionGzip:
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(payload)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+	return &buf, nil
+}
+
+func (tracer *Tracer) defaultSendReport(ctx context.Context, endpoint, target, token string, report *Report) error {
 	var buf bytes.Buffer
 	err := json.NewEncoder(&buf).Encode(report)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", endpoint+"/"+target, &buf)
+	body := &buf
+	compressed := tracer.compression != CompressionNone && buf.Len() >= tracer.compressionMinSize
+	if compressed {
+		body, err = compress(tracer.compression, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint+"/"+target, body)
 	if err != nil {
 		return err
 	}
 	req.Header.Add("Content-Type", "application/json")
+	if compressed {
+		req.Header.Add("Content-Encoding", string(tracer.compression))
+	}
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
 	req.Header.Add("X-Usage-API-Version", "2")
 
-	res, err := http.DefaultClient.Do(req)
+	if tracer.requestHook != nil {
+		err = tracer.requestHook(req)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := tracer.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
-		defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
 		body, _ := io.ReadAll(res.Body)
-		bodyStr := string(body)
-		if bodyStr == "" {
-			return fmt.Errorf("report sending failed with %s (no body)", res.Status)
-		} else {
-			return fmt.Errorf("report sending failed with %s: %s", res.Status, bodyStr)
+		sendErr := &SendReportError{
+			StatusCode: res.StatusCode,
+			Status:     res.Status,
+			Body:       string(body),
 		}
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+			sendErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+		}
+		return sendErr
 	}
 
+	// reading the body to the end lets the connection be reused
+	_, _ = io.Copy(io.Discard, res.Body)
 	return nil
 }
 
+// WithHTTPClient sets the HTTP client used by the default report sender.
+// Use it to configure proxies, custom CA roots, mTLS, connection pooling or request timeouts.
+// Has no effect when using a custom report sender.
+// Defaults to [http.DefaultClient], which is also used when the client is nil.
+func WithHTTPClient(client *http.Client) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		if client == nil {
+			client = http.DefaultClient
+		}
+		tracer.httpClient = client
+	})
+}
+
+// RequestHook modifies the report request before the default report sender sends it.
+// Returning an error aborts the sending.
+type RequestHook func(req *http.Request) error
+
+// WithRequestHook sets the hook for modifying report requests, like adding tracing propagation or authentication headers.
+// Has no effect when using a custom report sender.
+func WithRequestHook(hook RequestHook) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.requestHook = hook
+	})
+}
+
+// SendReportError is returned by the default report sender when GraphQL Hive responds with a non-OK status.
+// Custom report senders can return it too in order to control retrying.
+type SendReportError struct {
+	// HTTP status code of the response
+	StatusCode int
+	// HTTP status of the response
+	// e.g. "400 Bad Request"
+	Status string
+	// Body of the response, may be empty
+	Body string
+	// Delay requested through the "Retry-After" response header, zero when absent
+	RetryAfter time.Duration
+}
+
+func (err *SendReportError) Error() string {
+	if err.Body == "" {
+		return fmt.Sprintf("report sending failed with %s (no body)", err.Status)
+	}
+	return fmt.Sprintf("report sending failed with %s: %s", err.Status, err.Body)
+}
+
+// Permanent reports whether sending the same report again is bound to fail.
+// Client errors are permanent, except for request timeouts and rate limiting.
+func (err *SendReportError) Permanent() bool {
+	switch err.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return err.StatusCode >= 400 && err.StatusCode < 500
+}
+
+func isPermanentSendReportError(err error) bool {
+	var sendErr *SendReportError
+	return errors.As(err, &sendErr) && sendErr.Permanent()
+}
+
+// parseRetryAfter parses the "Retry-After" header value which is either
+// a number of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
 // SendReport performs the actual report sending to GraphQL Hive.
 type SendReport func(ctx context.Context, endpoint, target, token string, report *Report) error
 
@@ -92,6 +409,190 @@ func WithSendReport(fn SendReport) TracerOption {
 	})
 }
 
+// RetryPolicy configures retrying of failed report sends.
+type RetryPolicy struct {
+	// Maximum number of attempts to send a report, including the first one.
+	// Retrying is disabled when less than 2.
+	MaxAttempts int
+	// Backoff before the first retry, doubling with each subsequent retry.
+	BaseBackoff time.Duration
+	// Upper bound of the backoff between retries. Longer waits requested with "Retry-After" pause the sending instead.
+	MaxBackoff time.Duration
+	// Randomization factor of the backoff between 0 and 1.
+	// e.g. 0.2 with a backoff of 1s will wait between 800ms and 1.2s.
+	Jitter float64
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseBackoff: 500 * time.Millisecond,
+	MaxBackoff:  10 * time.Second,
+	Jitter:      0.2,
+}
+
+// WithRetryPolicy sets the retry policy for failed report sends.
+// Permanently failing reports (like when GraphQL Hive responds with 400, 401 or 403) are dropped,
+// otherwise the report goes back to the queue once all attempts fail and will be sent with the next one.
+// The "Retry-After" header is respected on 429 and 503 responses. When it asks to wait longer than the max backoff,
+// or there are no attempts left, the report goes back to the queue and no reports are sent until the time passes.
+// Reports sent synchronously, see [WithSendReportTimeout], are not retried so that the responses aren't held up.
+// Defaults to 3 attempts with a base backoff of 500ms, max backoff of 10s and a jitter of 0.2.
+func WithRetryPolicy(policy RetryPolicy) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.retryPolicy = policy
+	})
+}
+
+// backoff calculates the wait duration before retrying the given failed attempt.
+func (policy RetryPolicy) backoff(attempt int, err error) time.Duration {
+	var sendErr *SendReportError
+	if errors.As(err, &sendErr) && sendErr.RetryAfter > 0 {
+		return sendErr.RetryAfter
+	}
+
+	backoff := policy.BaseBackoff
+	for i := 1; i < attempt && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, policy.MaxBackoff)
+	if policy.Jitter > 0 {
+		backoff += time.Duration((rand.Float64()*2 - 1) * policy.Jitter * float64(backoff))
+	}
+	return backoff
+}
+
+// Exclude decides whether the operation should be excluded from reporting.
+type Exclude func(operationCtx *graphql.OperationContext) bool
+
+// ExcludeOperationNames excludes operations with any of the given names.
+func ExcludeOperationNames(names ...string) Exclude {
+	return func(operationCtx *graphql.OperationContext) bool {
+		return slices.Contains(names, operationCtx.Operation.Name)
+	}
+}
+
+// ExcludeOperationNamesMatching excludes operations whose name matches the given pattern.
+func ExcludeOperationNamesMatching(pattern *regexp.Regexp) Exclude {
+	return func(operationCtx *graphql.OperationContext) bool {
+		return pattern.MatchString(operationCtx.Operation.Name)
+	}
+}
+
+// WithExclude adds exclusions of operations from reporting, like health checks or synthetic monitoring.
+// Operations are excluded if any of the exclusions matches. Exclusions are checked before the operation
+// gets executed and are therefore not reported at all.
+func WithExclude(excludes ...Exclude) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.excludes = append(tracer.excludes, excludes...)
+	})
+}
+
+// WithExcludeIntrospection sets whether pure introspection operations, querying only
+// fields like __schema and __type, are excluded from reporting.
+// Defaults to false.
+func WithExcludeIntrospection(exclude bool) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.excludeIntrospection = exclude
+	})
+}
+
+// WithNormalizeOperations sets whether the reported operation documents are normalized. Normalizing hides
+// literal numbers and strings, removes aliases and comments, and sorts the fields, arguments and definitions.
+// Operations differing only in these are then reported as one because their IDs are generated from the
+// normalized documents.
+// Defaults to false.
+func WithNormalizeOperations(normalize bool) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.normalizeOperations = normalize
+	})
+}
+
+// PrivacyPolicy controls what the reported operation documents reveal.
+type PrivacyPolicy struct {
+	// Replace literal strings and numbers with empty strings and zeros
+	HideLiterals bool
+	// Remove comments
+	DropComments bool
+	// Replace the values of arguments, input object fields and variable defaults with these names
+	// e.g. ["password", "email"]
+	RedactArguments []string
+	// Replace the whole document with its SHA-256 hash
+	HashDocument bool
+}
+
+// rewritesDocument reports whether the policy needs the document to be rewritten.
+func (policy PrivacyPolicy) rewritesDocument() bool {
+	return policy.HideLiterals || policy.DropComments || len(policy.RedactArguments) != 0
+}
+
+// WithPrivacyPolicy sets the privacy policy applied to the reported operation documents. Operation IDs are generated
+// from the reported documents when the policy is in place, so custom ID generators don't get to see the original documents.
+// Defaults to reporting the documents as they are, apart from keeping only the executed operation.
+func WithPrivacyPolicy(policy PrivacyPolicy) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.privacyPolicy = policy
+	})
+}
+
+// WithReportInvalidOperations sets whether operations failing parsing or validation are reported.
+// They are reported as failed, together with the raw document, or a placeholder when the document
+// cannot be parsed, and are logged too. Exclusions and sampling don't apply to them.
+// Defaults to false.
+func WithReportInvalidOperations(report bool) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.reportInvalidOperations = report
+	})
+}
+
+// Sampler decides the rate, between 0 and 1, at which the operation is sampled for reporting.
+// e.g. 0.1 reports roughly one in ten executions of the operation.
+type Sampler func(ctx context.Context, operationCtx *graphql.OperationContext) float64
+
+// WithSampleRate sets a fixed rate, between 0 and 1, at which operations are sampled for reporting.
+// Every unique operation, by its document and name regardless of the generated ID, is still reported at least
+// once per report to keep the schema usage accurate, or once per default send report timeout when sending synchronously.
+// Defaults to 1 which reports all operations.
+func WithSampleRate(rate float64) TracerOption {
+	return WithSampler(func(ctx context.Context, operationCtx *graphql.OperationContext) float64 {
+		return rate
+	})
+}
+
+// WithSampler sets the sampler deciding the sample rate of each operation, like by the operation name or client.
+// Every unique operation, by its document and name regardless of the generated ID, is still reported at least
+// once per report to keep the schema usage accurate, or once per default send report timeout when sending synchronously.
+func WithSampler(sampler Sampler) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.sampler = sampler
+	})
+}
+
+const (
+	defaultClientNameHeader    = "x-graphql-client-name"
+	defaultClientVersionHeader = "x-graphql-client-version"
+)
+
+// WithClientHeaders sets the names of the request headers carrying the name and version of the client executing the operation.
+// Operations without the client name header are reported with the tracer's own client info.
+// Defaults to "x-graphql-client-name" and "x-graphql-client-version".
+func WithClientHeaders(nameHeader, versionHeader string) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.clientNameHeader = nameHeader
+		tracer.clientVersionHeader = versionHeader
+	})
+}
+
+// ClientInfo extracts the info of the client executing the operation from the operation's context.
+// Returning nil falls back to detecting the client from the request headers.
+type ClientInfo func(ctx context.Context) *Client
+
+// WithClientInfo sets the custom client info extraction.
+func WithClientInfo(fn ClientInfo) TracerOption {
+	return tracerOptionFn(func(tracer *Tracer) {
+		tracer.clientInfo = fn
+	})
+}
+
 // WithLogger sets the logger to be used by the tracer.
 // The logger is used for reporting errors during tracing. If set to nil, logging is disabled.
 // You can use the standard Go logger or provide a custom implementation (e.g., logrus, zap).